@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	wh "gpu-resource-toleration-admission-controller/webhook"
+)
+
+// runAudit reports the pods and pod templates of the cluster, or of kubectl
+// get -o json dumps, which tolerate extended resources they do not request or
+// request extended resources they do not tolerate.
+func runAudit(args []string) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+
+	var configFile string
+	var targetResources wh.ArrayFlags
+	var kubeconfig string
+	var namespace string
+	var files wh.ArrayFlags
+	var enforcementMode string
+	var output string
+
+	flags.Var(&targetResources, "targetResource", "target resource to add tolerations for, as name[:effect[,effect...]]")
+	flags.StringVar(&configFile, "config", "", "YAML or JSON configuration file of the target resources")
+	flags.StringVar(&kubeconfig, "kubeconfig", "", "kubeconfig of the cluster, the in-cluster config if empty")
+	flags.StringVar(&namespace, "namespace", "", "namespace of the objects listed from the cluster, all if empty")
+	flags.Var(&files, "f", "file of objects exported by kubectl get -o json, in place of the cluster; may be repeated")
+	flags.StringVar(&enforcementMode, "enforcement", string(wh.EnforcementEnforce), "enforcement mode of the rules which set none, Enforce, Warn or Audit")
+	flags.StringVar(&output, "o", "table", "output format, table, json or junit")
+	flags.Parse(args)
+
+	if output != "table" && output != "json" && output != "junit" {
+		log.Fatalf("Invalid flag: unsupported output format %q, expect table, json or junit\n", output)
+	}
+	if err := wh.SetEnforcementMode(enforcementMode); err != nil {
+		log.Fatalf("Invalid flag: %s\n", err)
+	}
+
+	if err := loadConfig(configFile, targetResources); err != nil {
+		log.Fatalf("Invalid config: %s\n", err)
+	}
+
+	var objects []json.RawMessage
+	if len(files) == 0 {
+		client, dynamicClient, err := newClient(kubeconfig)
+		if err != nil {
+			log.Fatalf("Failed to create client: %s\n", err)
+		}
+		if objects, err = wh.ListAuditObjects(client, dynamicClient, namespace); err != nil {
+			log.Fatalf("Failed to list objects: %s\n", err)
+		}
+	}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %s\n", file, err)
+		}
+		documents, err := wh.ReadDocuments(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Failed to read %s: %s\n", file, err)
+		}
+		objects = append(objects, documents...)
+	}
+
+	report, err := wh.Audit(objects)
+	if err != nil {
+		log.Fatalf("Failed to audit objects: %s\n", err)
+	}
+
+	switch output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	case "junit":
+		err = report.WriteJUnit(os.Stdout)
+	default:
+		err = report.WriteTable(os.Stdout)
+	}
+	if err != nil {
+		log.Fatalf("Failed to write report: %s\n", err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	wh "gpu-resource-toleration-admission-controller/webhook"
+)
+
+// runBackfill reports, and optionally patches, the workloads whose existing
+// pods lack the tolerations the mutating webhook would add, once or every
+// interval.
+func runBackfill(args []string) {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+
+	var configFile string
+	var targetResources wh.ArrayFlags
+	var kubeconfig string
+	var namespace string
+	var podListFile string
+	var output string
+	var patch bool
+	var interval time.Duration
+
+	flags.Var(&targetResources, "targetResource", "target resource to add tolerations for, as name[:effect[,effect...]]")
+	flags.StringVar(&configFile, "config", "", "YAML or JSON configuration file of the target resources")
+	flags.StringVar(&kubeconfig, "kubeconfig", "", "kubeconfig of the cluster, the in-cluster config if empty")
+	flags.StringVar(&namespace, "namespace", "", "namespace of the pods, all if empty")
+	flags.StringVar(&podListFile, "f", "", "file of pods exported by kubectl get pods,replicasets,jobs -A -o json, in place of the cluster")
+	flags.StringVar(&output, "o", "table", "output format, table or json")
+	flags.BoolVar(&patch, "patch", false, "add the missing tolerations to the pod templates of the owning workloads")
+	flags.DurationVar(&interval, "interval", 0, "reconcile every interval instead of once")
+	flags.Parse(args)
+
+	if output != "table" && output != "json" {
+		log.Fatalf("Invalid flag: unsupported output format %q, expect table or json\n", output)
+	}
+	if podListFile != "" && (patch || interval != 0) {
+		log.Fatalln("Invalid flag: -patch and -interval require a cluster, not -f")
+	}
+
+	if err := loadConfig(configFile, targetResources); err != nil {
+		log.Fatalf("Invalid config: %s\n", err)
+	}
+
+	var client kubernetes.Interface
+	var dynamicClient dynamic.Interface
+	if podListFile == "" {
+		var err error
+		if client, dynamicClient, err = newClient(kubeconfig); err != nil {
+			log.Fatalf("Failed to create client: %s\n", err)
+		}
+	}
+	backfiller := wh.NewBackfiller(client, dynamicClient, patch)
+
+	for {
+		var pods []corev1.Pod
+		var err error
+		if podListFile != "" {
+			pods, err = backfiller.LoadPodListFile(podListFile)
+		} else {
+			pods, err = backfiller.ListPods(namespace)
+		}
+
+		if err != nil {
+			log.Printf("Failed to load pods: %s\n", err)
+		} else if err := writeBackfillResults(output, backfiller.Reconcile(pods)); err != nil {
+			log.Fatalf("Failed to write results: %s\n", err)
+		}
+
+		if interval == 0 {
+			if err != nil {
+				os.Exit(1)
+			}
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+func writeBackfillResults(output string, results []wh.BackfillResult) error {
+	if output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	}
+
+	if len(results) == 0 {
+		fmt.Println("No pods lack tolerations.")
+		return nil
+	}
+	return wh.WriteBackfillReport(os.Stdout, results)
+}
+
+// loadConfig activates the rules of the configuration file, or of the
+// -targetResource flags only.
+func loadConfig(configFile string, targetResources wh.ArrayFlags) error {
+	if configFile != "" {
+		return wh.NewConfigWatcher(configFile, targetResources, 0).Load()
+	}
+
+	return wh.SetTargetResourcesSet(targetResources)
+}
+
+// newClient returns a typed and a dynamic client of the cluster of the
+// kubeconfig, or of the cluster the process runs in.
+func newClient(kubeconfig string) (kubernetes.Interface, dynamic.Interface, error) {
+	var restConfig *rest.Config
+	var err error
+
+	if kubeconfig != "" {
+		restConfig, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		restConfig, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return client, dynamicClient, nil
+}
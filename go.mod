@@ -4,7 +4,10 @@ go 1.13
 
 require (
 	github.com/deckarep/golang-set v1.7.1
+	github.com/evanphx/json-patch v4.9.0+incompatible
 	k8s.io/api v0.19.4
 	k8s.io/apimachinery v0.19.4
+	k8s.io/client-go v0.19.4
 	k8s.io/klog v1.0.0
+	sigs.k8s.io/yaml v1.2.0
 )
@@ -7,40 +7,133 @@ import (
 	"log"
 
 	"fmt"
-	// "net/http"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 
 	wh "gpu-resource-toleration-admission-controller/webhook"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backfill":
+			runBackfill(os.Args[2:])
+			return
+		case "simulate":
+			runSimulate(os.Args[2:])
+			return
+		case "audit":
+			runAudit(os.Args[2:])
+			return
+		}
+	}
+
 	var port int
 	var certFile string
 	var keyFile string
+	var configFile string
+	var configReloadInterval time.Duration
+	var mutatePodTemplates bool
+	var wildcardTolerationPolicy string
+	var enforcementMode string
+	var namespaceLabelsFromCluster bool
+	var taintNodes bool
 	var targetResources wh.ArrayFlags
 
 	flag.IntVar(&port, "port", 8443, "webhook server port")
-	flag.Var(&targetResources, "targetResource", "target resource to add taints")
+	flag.Var(&targetResources, "targetResource", "target resource to add tolerations for, as name[:effect[,effect...]] (default effects: NoSchedule,NoExecute; All tolerates every effect)")
+	flag.StringVar(&configFile, "config", "", "YAML or JSON configuration file of the target resources, e.g. /etc/webhook/config/config.yaml")
+	flag.DurationVar(&configReloadInterval, "configReloadInterval", 10*time.Second, "interval to check the config file for changes")
+	flag.BoolVar(&mutatePodTemplates, "mutatePodTemplates", false, "also add tolerations to the pod templates of Deployments, StatefulSets, DaemonSets, ReplicaSets, Jobs and CronJobs")
+	flag.StringVar(&enforcementMode, "enforcement", string(wh.EnforcementEnforce), "response to tolerations of the taints of extended resources not requested, Enforce, Warn or Audit, unless set in the config file")
+	flag.StringVar(&wildcardTolerationPolicy, "wildcardTolerations", string(wh.WildcardTolerationDeny), "response to tolerations without a key which tolerate the taints of extended resources not requested, Deny or Warn")
+	flag.BoolVar(&namespaceLabelsFromCluster, "namespaceLabelsFromCluster", false, "look up namespace labels for the namespace selectors of the config in the cluster instead of the config")
+	flag.BoolVar(&taintNodes, "taintNodes", false, "also taint the nodes advertising target resources with the taints of their rules, and remove the taints it added for resources no longer advertised")
 	flag.StringVar(&certFile, "tlsCertFile", "/etc/webhook/certs/cert.pem", "x509 Certificate file for TLS connection")
 	flag.StringVar(&keyFile, "tlsKeyFile", "/etc/webhook/certs/key.pem", "x509 Private key file for TLS connection")
 	flag.Parse()
 
-	wh.SetTargetResourcesSet(targetResources)
+	if err := wh.SetEnforcementMode(enforcementMode); err != nil {
+		log.Fatalf("Invalid flag: %s\n", err)
+	}
 
 	keyPair, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
-		log.Printf("Failed to load key pair: %s\n", err)
+		log.Fatalf("Failed to load key pair: %s\n", err)
+	}
+
+	stopCh := make(chan struct{})
+	var readinessChecks []wh.ReadinessCheck
+
+	if configFile != "" {
+		configWatcher := wh.NewConfigWatcher(configFile, targetResources, configReloadInterval)
+		if err := configWatcher.Load(); err != nil {
+			log.Fatalf("Failed to load config: %s\n", err)
+		}
+		readinessChecks = append(readinessChecks, wh.ReadinessCheck{Name: "config", Check: configWatcher.Ready})
+
+		go configWatcher.Run(stopCh)
+	} else if err := wh.SetTargetResourcesSet(targetResources); err != nil {
+		log.Fatalf("Invalid config: %s\n", err)
+	}
+
+	wh.SetMutatePodTemplates(mutatePodTemplates)
+	if err := wh.SetWildcardTolerationPolicy(wildcardTolerationPolicy); err != nil {
+		log.Fatalf("Invalid flag: %s\n", err)
+	}
+
+	if namespaceLabelsFromCluster || taintNodes {
+		restConfig, err := rest.InClusterConfig()
+		if err != nil {
+			log.Fatalf("Failed to load in-cluster config: %s\n", err)
+		}
+
+		client := kubernetes.NewForConfigOrDie(restConfig)
+		informerFactory := informers.NewSharedInformerFactory(client, 10*time.Minute)
+
+		var nodeTainter *wh.NodeTainter
+		if taintNodes {
+			eventBroadcaster := record.NewBroadcaster()
+			eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+			recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "gpu-resource-toleration-admission-controller"})
+
+			nodeTainter = wh.NewNodeTainter(client, informerFactory.Core().V1().Nodes(), recorder)
+		}
+
+		var namespaceInformer cache.SharedIndexInformer
+		if namespaceLabelsFromCluster {
+			namespaceInformer = informerFactory.Core().V1().Namespaces().Informer()
+			wh.SetNamespaceLister(informerFactory.Core().V1().Namespaces().Lister())
+		}
+
+		informerFactory.Start(stopCh)
+		if namespaceInformer != nil && !cache.WaitForCacheSync(stopCh, namespaceInformer.HasSynced) {
+			log.Fatalln("Failed to sync namespace cache")
+		}
+		if nodeTainter != nil {
+			go nodeTainter.Run(1, stopCh)
+		}
 	}
 
-	webhookServer := wh.GetAdmissionWebhookServer(keyPair, port)
+	webhookServer := wh.GetAdmissionWebhookServer(keyPair, port, readinessChecks...)
 
 	fmt.Println("Starting xx webhook server...")
 
 	go func() {
-		if err := webhookServer.ListenAndServeTLS("", ""); err != nil {
-			log.Printf("Failed to listen and serve webhook server: %s\n", err)
+		if err := webhookServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to listen and serve webhook server: %s\n", err)
 		}
 	}()
 
@@ -49,5 +142,6 @@ func main() {
 	<-sigCh
 
 	log.Println("OS shutdown signal received...")
+	close(stopCh)
 	webhookServer.Shutdown(context.Background())
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"sigs.k8s.io/yaml"
+
+	wh "gpu-resource-toleration-admission-controller/webhook"
+)
+
+// runSimulate prints what the webhooks would do to the objects of a manifest
+// on creation, without a server or a cluster. It exits with status 1 when an
+// object would be denied.
+func runSimulate(args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+
+	var file string
+	var configFile string
+	var targetResources wh.ArrayFlags
+	var namespace string
+	var username string
+	var groups wh.ArrayFlags
+	var mutatePodTemplates bool
+	var enforcementMode string
+	var wildcardTolerationPolicy string
+	var output string
+
+	flags.StringVar(&file, "f", "", "YAML or JSON manifest of pods or workloads, - for stdin; multiple documents and lists are supported")
+	flags.Var(&targetResources, "targetResource", "target resource to add tolerations for, as name[:effect[,effect...]]")
+	flags.StringVar(&configFile, "config", "", "YAML or JSON configuration file of the target resources")
+	flags.StringVar(&namespace, "namespace", "default", "namespace of the objects which set none")
+	flags.StringVar(&username, "as", "", "username of the request, for exemptions")
+	flags.Var(&groups, "as-group", "group of the user of the request, for exemptions")
+	flags.BoolVar(&mutatePodTemplates, "mutatePodTemplates", false, "also add tolerations to the pod templates of workloads")
+	flags.StringVar(&enforcementMode, "enforcement", string(wh.EnforcementEnforce), "enforcement mode of the rules which set none, Enforce, Warn or Audit")
+	flags.StringVar(&wildcardTolerationPolicy, "wildcardTolerations", string(wh.WildcardTolerationDeny), "response to tolerations without a key, Deny or Warn")
+	flags.StringVar(&output, "o", "text", "output format, text or json")
+	flags.Parse(args)
+
+	if file == "" {
+		log.Fatalln("Invalid flag: -f is required")
+	}
+	if output != "text" && output != "json" {
+		log.Fatalf("Invalid flag: unsupported output format %q, expect text or json\n", output)
+	}
+	if err := wh.SetEnforcementMode(enforcementMode); err != nil {
+		log.Fatalf("Invalid flag: %s\n", err)
+	}
+	if err := wh.SetWildcardTolerationPolicy(wildcardTolerationPolicy); err != nil {
+		log.Fatalf("Invalid flag: %s\n", err)
+	}
+	wh.SetMutatePodTemplates(mutatePodTemplates)
+
+	if err := loadConfig(configFile, targetResources); err != nil {
+		log.Fatalf("Invalid config: %s\n", err)
+	}
+
+	var in io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			log.Fatalf("Failed to open manifest: %s\n", err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	documents, err := wh.ReadDocuments(in)
+	if err != nil {
+		log.Fatalf("Failed to read manifest %s: %s\n", file, err)
+	}
+
+	userInfo := authenticationv1.UserInfo{Username: username, Groups: groups}
+	var results []*wh.SimulationResult
+	denied := false
+	for i, document := range documents {
+		result, err := wh.Simulate(document, namespace, userInfo)
+		if err != nil {
+			log.Fatalf("Failed to simulate document %d: %s\n", i+1, err)
+		}
+		results = append(results, result)
+		denied = denied || !result.Allowed
+	}
+
+	if output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(results)
+	} else {
+		err = writeSimulationResults(os.Stdout, results)
+	}
+	if err != nil {
+		log.Fatalf("Failed to write results: %s\n", err)
+	}
+
+	if denied {
+		os.Exit(1)
+	}
+}
+
+func writeSimulationResults(w io.Writer, results []*wh.SimulationResult) error {
+	for i, result := range results {
+		if i > 0 {
+			fmt.Fprintln(w, "---")
+		}
+		fmt.Fprintf(w, "# %s %s/%s\n", result.Kind, result.Namespace, result.Name)
+
+		if result.Ignored {
+			fmt.Fprintln(w, "# Ignored: not a pod or workload")
+			continue
+		}
+
+		if result.Patch != nil {
+			fmt.Fprintf(w, "# Patch: %s\n", result.Patch)
+		} else {
+			fmt.Fprintln(w, "# Patch: none")
+		}
+
+		if result.Allowed {
+			fmt.Fprintln(w, "# Decision: allowed")
+		} else {
+			fmt.Fprintf(w, "# Decision: denied: %s\n", result.Message)
+		}
+		for _, warning := range result.Warnings {
+			fmt.Fprintf(w, "# Warning: %s\n", warning)
+		}
+
+		var keys []string
+		for key := range result.AuditAnnotations {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "# Audit annotation %s: %s\n", key, result.AuditAnnotations[key])
+		}
+
+		object, err := yaml.JSONToYAML(result.Object)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(object); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,358 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// Audit issue types.
+const (
+	// AuditIssueForbiddenToleration is a toleration of the taint of an
+	// extended resource the pod does not request.
+	AuditIssueForbiddenToleration = "ForbiddenToleration"
+	// AuditIssueMissingToleration is a toleration of an extended resource
+	// the pod requests which the pod does not carry.
+	AuditIssueMissingToleration = "MissingToleration"
+)
+
+// AuditIssue is a violation of the rules by a pod or pod template.
+type AuditIssue struct {
+	Type    string `json:"type"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+	// Enforcement is the enforcement mode of the rule a forbidden
+	// toleration violates.
+	Enforcement EnforcementMode `json:"enforcement,omitempty"`
+}
+
+// AuditResult reports the issues of a pod or of the pod template of a
+// workload, none if it complies with the rules.
+type AuditResult struct {
+	Object WorkloadRef  `json:"object"`
+	Issues []AuditIssue `json:"issues,omitempty"`
+}
+
+// AuditGroup holds the results of the objects of a namespace managed by the
+// same workload.
+type AuditGroup struct {
+	Namespace string        `json:"namespace"`
+	Owner     WorkloadRef   `json:"owner"`
+	Objects   []AuditResult `json:"objects"`
+}
+
+// AuditReport is the result of an audit, grouped by namespace and owner.
+type AuditReport struct {
+	Groups  []AuditGroup `json:"groups"`
+	Objects int          `json:"objects"`
+	Issues  int          `json:"issues"`
+}
+
+// auditedKinds are listed from the cluster, with the API version they are
+// listed in. CronJobs are listed in the version served.
+var auditedKinds = []schema.GroupVersionKind{
+	{Version: "v1", Kind: podKind},
+	{Group: "apps", Version: "v1", Kind: deploymentKind},
+	{Group: "apps", Version: "v1", Kind: statefulSetKind},
+	{Group: "apps", Version: "v1", Kind: daemonSetKind},
+	{Group: "apps", Version: "v1", Kind: replicaSetKind},
+	{Group: "batch", Version: "v1", Kind: jobKind},
+	{Group: "batch", Kind: cronJobKind},
+}
+
+// ListAuditObjects lists the pods and workloads of the namespace, all if
+// empty, from the cluster, as objects of the form kubectl get -o json prints.
+// Kinds the cluster does not serve are skipped with a warning.
+func ListAuditObjects(client kubernetes.Interface, dynamicClient dynamic.Interface, namespace string) ([]json.RawMessage, error) {
+	var objects []json.RawMessage
+	ctx := context.TODO()
+	options := metav1.ListOptions{}
+
+	for _, gvk := range auditedKinds {
+		var items []runtime.Object
+		var err error
+
+		switch gvk.Kind {
+		case podKind:
+			list, listErr := client.CoreV1().Pods(namespace).List(ctx, options)
+			for i := 0; listErr == nil && i < len(list.Items); i++ {
+				items = append(items, &list.Items[i])
+			}
+			err = listErr
+		case deploymentKind:
+			list, listErr := client.AppsV1().Deployments(namespace).List(ctx, options)
+			for i := 0; listErr == nil && i < len(list.Items); i++ {
+				items = append(items, &list.Items[i])
+			}
+			err = listErr
+		case statefulSetKind:
+			list, listErr := client.AppsV1().StatefulSets(namespace).List(ctx, options)
+			for i := 0; listErr == nil && i < len(list.Items); i++ {
+				items = append(items, &list.Items[i])
+			}
+			err = listErr
+		case daemonSetKind:
+			list, listErr := client.AppsV1().DaemonSets(namespace).List(ctx, options)
+			for i := 0; listErr == nil && i < len(list.Items); i++ {
+				items = append(items, &list.Items[i])
+			}
+			err = listErr
+		case replicaSetKind:
+			list, listErr := client.AppsV1().ReplicaSets(namespace).List(ctx, options)
+			for i := 0; listErr == nil && i < len(list.Items); i++ {
+				items = append(items, &list.Items[i])
+			}
+			err = listErr
+		case jobKind:
+			list, listErr := client.BatchV1().Jobs(namespace).List(ctx, options)
+			for i := 0; listErr == nil && i < len(list.Items); i++ {
+				items = append(items, &list.Items[i])
+			}
+			err = listErr
+		case cronJobKind:
+			resource, resourceErr := getCronJobResource(client)
+			if resourceErr != nil {
+				klog.Warningf("Skipping %s objects: %v", gvk.Kind, resourceErr)
+				continue
+			}
+			gvk.Version = resource.Version
+
+			list, listErr := dynamicClient.Resource(resource).Namespace(namespace).List(ctx, options)
+			for i := 0; listErr == nil && i < len(list.Items); i++ {
+				items = append(items, &list.Items[i])
+			}
+			err = listErr
+		}
+		if apierrors.IsNotFound(err) {
+			klog.Warningf("Skipping %s objects, which are not served: %v", gvk.Kind, err)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not list %s objects: %v", gvk.Kind, err)
+		}
+
+		// Listed items carry no kind, which the objects are told apart by.
+		for _, item := range items {
+			item.GetObjectKind().SetGroupVersionKind(gvk)
+			data, err := json.Marshal(item)
+			if err != nil {
+				return nil, err
+			}
+			objects = append(objects, data)
+		}
+	}
+
+	return objects, nil
+}
+
+// Audit evaluates the pods and the pod templates of the workloads among the
+// objects with the active rule set, like the webhooks would on their
+// creation. ReplicaSets and Jobs managed by another workload are only used to
+// resolve the owners of their pods, as their template is the one of their
+// owner. Objects of exempt namespaces and of other kinds are skipped.
+func Audit(objects []json.RawMessage) (*AuditReport, error) {
+	ruleSet := GetActiveRuleSet()
+	owners := newOwnerResolver(nil)
+
+	var requests []*admissionv1.AdmissionRequest
+	var metas []*metav1.ObjectMeta
+	for i, object := range objects {
+		req, meta, err := newObjectRequest(object, "")
+		if err != nil {
+			return nil, fmt.Errorf("object %d: %v", i+1, err)
+		}
+		owners.add(req.Kind.Kind, meta)
+		requests = append(requests, req)
+		metas = append(metas, meta)
+	}
+
+	report := &AuditReport{}
+	groups := make(map[WorkloadRef]int)
+	for i, req := range requests {
+		meta := metas[i]
+		kind := req.Kind.Kind
+
+		if ruleSet.exemptionReason(meta.Namespace) != "" {
+			continue
+		}
+		if (kind == replicaSetKind || kind == jobKind) && metav1.GetControllerOfNoCopy(meta) != nil {
+			continue
+		}
+
+		template, err := getPodTemplate(req)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s/%s: %v", kind, meta.Namespace, meta.Name, err)
+		}
+		if template == nil {
+			continue
+		}
+
+		result := AuditResult{
+			Object: WorkloadRef{Kind: kind, Namespace: meta.Namespace, Name: meta.Name},
+			Issues: auditPodTemplate(template),
+		}
+		report.Objects++
+		report.Issues += len(result.Issues)
+
+		owner := owners.resolveWorkload(kind, meta)
+		j, ok := groups[owner]
+		if !ok {
+			j = len(report.Groups)
+			groups[owner] = j
+			report.Groups = append(report.Groups, AuditGroup{Namespace: owner.Namespace, Owner: owner})
+		}
+		report.Groups[j].Objects = append(report.Groups[j].Objects, result)
+	}
+
+	sort.Slice(report.Groups, func(i, j int) bool {
+		x, y := report.Groups[i], report.Groups[j]
+		if x.Namespace != y.Namespace {
+			return x.Namespace < y.Namespace
+		}
+		return x.Owner.String() < y.Owner.String()
+	})
+
+	return report, nil
+}
+
+// auditPodTemplate returns the forbidden tolerations of the pod template, and
+// the tolerations it lacks for the extended resources it requests.
+func auditPodTemplate(template *podTemplate) []AuditIssue {
+	var issues []AuditIssue
+	tolerationsPath := template.tolerationsPath()
+
+	requester := &requester{namespace: template.Pod.Namespace, serviceAccountName: template.Pod.Spec.ServiceAccountName}
+	violations, _ := getTolerationViolations(&template.Pod, requester)
+	for _, violation := range violations {
+		issues = append(issues, AuditIssue{
+			Type:        AuditIssueForbiddenToleration,
+			Field:       tolerationsPath.Index(violation.index).String(),
+			Message:     violation.message(),
+			Enforcement: violation.taint.resource.enforcementMode(),
+		})
+	}
+
+	for _, toleration := range GetExtendResourceTolerationsToAdd(&template.Pod) {
+		issues = append(issues, AuditIssue{
+			Type:    AuditIssueMissingToleration,
+			Field:   tolerationsPath.String(),
+			Message: fmt.Sprintf("toleration %s of an extended resource requested by a container is missing", formatToleration(toleration)),
+		})
+	}
+
+	return issues
+}
+
+// WriteTable writes the issues as a table, followed by a summary.
+func (r *AuditReport) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tOWNER\tOBJECT\tISSUE\tFIELD\tMESSAGE")
+
+	for _, group := range r.Groups {
+		for _, result := range group.Objects {
+			for _, issue := range result.Issues {
+				issueType := issue.Type
+				if issue.Enforcement != "" {
+					issueType += " (" + string(issue.Enforcement) + ")"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", group.Namespace, group.Owner, result.Object, issueType, issue.Field, issue.Message)
+			}
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "\n%d issues in %d objects audited\n", r.Issues, r.Objects)
+	return err
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit writes the report as JUnit XML, with a test suite per namespace
+// and a test case per object, named after its owner, which fails with the
+// issues of the object.
+func (r *AuditReport) WriteJUnit(w io.Writer) error {
+	suites := junitTestSuites{Name: "gpu-resource-toleration-audit"}
+	index := make(map[string]int)
+
+	for _, group := range r.Groups {
+		i, ok := index[group.Namespace]
+		if !ok {
+			i = len(suites.Suites)
+			index[group.Namespace] = i
+			suites.Suites = append(suites.Suites, junitTestSuite{Name: group.Namespace})
+		}
+		suite := &suites.Suites[i]
+
+		for _, result := range group.Objects {
+			testCase := junitTestCase{ClassName: group.Namespace + "." + group.Owner.String(), Name: result.Object.String()}
+			if len(result.Issues) != 0 {
+				var lines []string
+				for _, issue := range result.Issues {
+					lines = append(lines, fmt.Sprintf("%s: %s: %s", issue.Type, issue.Field, issue.Message))
+				}
+				testCase.Failure = &junitFailure{
+					Message: fmt.Sprintf("issues: %d", len(result.Issues)),
+					Type:    result.Issues[0].Type,
+					Text:    strings.Join(lines, "\n"),
+				}
+				suite.Failures++
+				suites.Failures++
+			}
+			suite.TestCases = append(suite.TestCases, testCase)
+			suite.Tests++
+			suites.Tests++
+		}
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,142 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAudit(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+	SetTargetResourcesSet(ArrayFlags{nvidia})
+
+	_, objects := newBackfillObjects(nvidia)
+	sneaky := newPodRequesting("", corev1.Toleration{Key: nvidia, Operator: corev1.TolerationOpExists})
+	sneaky.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"}
+	sneaky.ObjectMeta = metav1.ObjectMeta{Namespace: "ml", Name: "sneaky"}
+	objects = append(objects, &sneaky)
+	cronJob := newCronJob(t, nvidia, "v1", "ml", "nightly")
+
+	// The ReplicaSet is audited through its Deployment, and the pod of the
+	// exempt namespace is skipped.
+	expected := []struct {
+		owner   string
+		objects []string
+		issues  int
+	}{
+		{"CronJob/nightly", []string{"CronJob/nightly"}, len(DefaultTolerationEffects)},
+		{"Deployment/train", []string{"Deployment/train", "Pod/train-7d9f-a", "Pod/train-7d9f-b"}, 3 * len(DefaultTolerationEffects)},
+		{"Job/batch", []string{"Job/batch", "Pod/batch-x1"}, 2 * len(DefaultTolerationEffects)},
+		{"Pod/notebook", []string{"Pod/notebook"}, len(DefaultTolerationEffects)},
+		{"Pod/sneaky", []string{"Pod/sneaky"}, 1},
+		{"Pod/tolerated", []string{"Pod/tolerated"}, 0},
+		{"StatefulSet/serve", []string{"StatefulSet/serve", "Pod/serve-0"}, 2 * len(DefaultTolerationEffects)},
+	}
+
+	// CronJobs are only served in batch/v1, which the typed client does not
+	// know.
+	client := fake.NewSimpleClientset(objects...)
+	serveCronJobs(client, "v1")
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), cronJob)
+	clusterObjects, err := ListAuditObjects(client, dynamicClient, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Kinds which are not served are skipped.
+	if unserved, err := ListAuditObjects(fake.NewSimpleClientset(objects...), dynamicClient, ""); err != nil || len(unserved) != len(clusterObjects)-1 {
+		t.Errorf("expected CronJobs to be skipped when not served, got %d objects (err: %v)", len(unserved), err)
+	}
+
+	list := corev1.List{TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "List"}}
+	for _, object := range append(objects, cronJob) {
+		list.Items = append(list.Items, runtime.RawExtension{Object: object})
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dumpObjects, err := ReadDocuments(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		objects     []json.RawMessage
+	}{
+		{"objects listed from the cluster", clusterObjects},
+		{"objects of a kubectl get -o json dump", dumpObjects},
+	}
+
+	for _, test := range tests {
+		report, err := Audit(test.objects)
+		if err != nil {
+			t.Errorf("Test (%s) Failed: unexpected error %v", test.description, err)
+			continue
+		}
+
+		if len(report.Groups) != len(expected) {
+			t.Errorf("Test (%s) Failed: expected %d groups, got %+v", test.description, len(expected), report.Groups)
+			continue
+		}
+		for i, group := range report.Groups {
+			var objects []string
+			issues := 0
+			for _, result := range group.Objects {
+				objects = append(objects, result.Object.String())
+				issues += len(result.Issues)
+			}
+			if group.Namespace != "ml" || group.Owner.String() != expected[i].owner || len(objects) != len(expected[i].objects) || issues != expected[i].issues {
+				t.Errorf("Test (%s) Failed: expected %s owning %v with %d issues, got %+v", test.description, expected[i].owner, expected[i].objects, expected[i].issues, group)
+			}
+		}
+
+		sneakyIssues := report.Groups[4].Objects[0].Issues
+		if len(sneakyIssues) != 1 || sneakyIssues[0].Type != AuditIssueForbiddenToleration || sneakyIssues[0].Field != "spec.tolerations[0]" || sneakyIssues[0].Enforcement != EnforcementEnforce {
+			t.Errorf("Test (%s) Failed: expected the toleration of the sneaky pod to be forbidden, got %+v", test.description, sneakyIssues)
+		}
+		for _, result := range report.Groups[1].Objects {
+			if reflect.DeepEqual(result.Object, WorkloadRef{Kind: "Deployment", Namespace: "ml", Name: "train"}) && result.Issues[0].Field != "spec.template.spec.tolerations" {
+				t.Errorf("Test (%s) Failed: expected the template of the deployment to lack tolerations, got %+v", test.description, result)
+			}
+		}
+	}
+
+	report, err := Audit(dumpObjects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Objects != 11 || report.Issues != 9*len(DefaultTolerationEffects)+1 {
+		t.Errorf("expected 11 objects with %d issues, got %d with %d", 9*len(DefaultTolerationEffects)+1, report.Objects, report.Issues)
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteTable(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != report.Issues+3 || !strings.Contains(lines[1], "CronJob/nightly") {
+		t.Errorf("expected a header, a line per issue and a summary, got\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := report.WriteJUnit(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var suites junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &suites); err != nil {
+		t.Fatalf("expected valid JUnit XML, got %v\n%s", err, buf.String())
+	}
+	if len(suites.Suites) != 1 || suites.Tests != 11 || suites.Failures != 10 || suites.Suites[0].TestCases[0].ClassName != "ml.CronJob/nightly" {
+		t.Errorf("expected a suite of 11 test cases of which 10 fail, got %+v", suites)
+	}
+}
@@ -0,0 +1,344 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// Backfill actions of a workload.
+const (
+	BackfillActionPatched         = "patched"
+	BackfillActionPatch           = "patch template"
+	BackfillActionPatchedRecreate = "patched, recreate pods"
+	BackfillActionPatchRecreate   = "patch template, recreate pods"
+	BackfillActionRecreate        = "recreate pods"
+	BackfillActionUpToDate        = "template up to date"
+	BackfillActionFailed          = "failed"
+)
+
+// patchableWorkloads are the workloads whose pod template can be patched,
+// with the resource their template is extracted from. The template of a Job is
+// immutable, its pods have to be recreated.
+var patchableWorkloads = map[string]schema.GroupResource{
+	deploymentKind:  {Group: "apps", Resource: "deployments"},
+	statefulSetKind: {Group: "apps", Resource: "statefulsets"},
+	daemonSetKind:   {Group: "apps", Resource: "daemonsets"},
+	replicaSetKind:  {Group: "apps", Resource: "replicasets"},
+	cronJobKind:     {Group: "batch", Resource: "cronjobs"},
+}
+
+// nonReplacingWorkloads are the patchable workloads which do not replace their
+// pods when their pod template changes: a ReplicaSet only creates pods from it
+// when it scales up, and a CronJob creates its next Jobs from it, while the
+// template of its running Jobs is immutable. Their pods have to be recreated
+// as well, and are patched by the mutating webhook when they are.
+var nonReplacingWorkloads = map[string]bool{
+	replicaSetKind: true,
+	cronJobKind:    true,
+}
+
+// BackfillResult reports a workload whose pods lack the tolerations of the
+// extended resources they use.
+type BackfillResult struct {
+	Workload WorkloadRef `json:"workload"`
+	// Pods are the names of the pods lacking tolerations.
+	Pods []string `json:"pods"`
+	// MissingTolerations are the tolerations lacked by any of the pods.
+	MissingTolerations []corev1.Toleration `json:"missingTolerations"`
+	// Action is what was done, or is to be done, about the workload.
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Backfiller finds the pods created before the webhook was installed, or
+// before the rules changed, which lack the tolerations the mutating webhook
+// would add, and the workloads owning them. With patching enabled, the pod
+// templates of the workloads are patched like the mutating webhook patches
+// pods, so that their pods are replaced by pods carrying the tolerations, or
+// carry them once recreated for workloads which do not replace their pods.
+type Backfiller struct {
+	// client lists pods, resolves owners and patches workloads. Without a
+	// client, owners are resolved with the objects of the loaded file.
+	client kubernetes.Interface
+	// dynamicClient reads and patches CronJobs, in the version served.
+	dynamicClient dynamic.Interface
+	patch         bool
+	owners        *ownerResolver
+}
+
+// NewBackfiller returns a Backfiller using the clients, which may be nil for
+// pods loaded from a file. Workloads are only patched when patch is set and
+// clients are given.
+func NewBackfiller(client kubernetes.Interface, dynamicClient dynamic.Interface, patch bool) *Backfiller {
+	return &Backfiller{
+		client:        client,
+		dynamicClient: dynamicClient,
+		patch:         patch,
+		owners:        newOwnerResolver(client),
+	}
+}
+
+// ListPods lists the pods of the namespace, all if empty, from the cluster.
+func (b *Backfiller) ListPods(namespace string) ([]corev1.Pod, error) {
+	list, err := b.client.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list pods: %v", err)
+	}
+
+	return list.Items, nil
+}
+
+// LoadPodListFile reads the pods of a file exported by kubectl get -o json or
+// -o yaml, either a single object or a list. ReplicaSets and Jobs exported
+// along with the pods, e.g. by kubectl get pods,replicasets,jobs, resolve the
+// owners of their pods.
+func (b *Backfiller) LoadPodListFile(path string) ([]corev1.Pod, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read pod list: %v", err)
+	}
+
+	var list struct {
+		metav1.TypeMeta `json:",inline"`
+		Items           []json.RawMessage `json:"items"`
+	}
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("could not parse pod list %s: %v", path, err)
+	}
+
+	items := list.Items
+	if !strings.HasSuffix(list.Kind, "List") {
+		object, err := yaml.YAMLToJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse pod list %s: %v", path, err)
+		}
+		items = append(items, object)
+	}
+
+	var pods []corev1.Pod
+	for i, item := range items {
+		var object struct {
+			metav1.TypeMeta   `json:",inline"`
+			metav1.ObjectMeta `json:"metadata"`
+		}
+		if err := json.Unmarshal(item, &object); err != nil {
+			return nil, fmt.Errorf("could not parse item %d of pod list %s: %v", i, path, err)
+		}
+		b.owners.add(object.Kind, &object.ObjectMeta)
+
+		if object.Kind != podKind {
+			continue
+		}
+		var pod corev1.Pod
+		if err := json.Unmarshal(item, &pod); err != nil {
+			return nil, fmt.Errorf("could not parse item %d of pod list %s: %v", i, path, err)
+		}
+		pods = append(pods, pod)
+	}
+
+	return pods, nil
+}
+
+// Reconcile reports the workloads of the pods lacking tolerations, patching
+// their templates if enabled. Pods of exempt namespaces are skipped.
+func (b *Backfiller) Reconcile(pods []corev1.Pod) []BackfillResult {
+	var results []BackfillResult
+	index := make(map[WorkloadRef]int)
+	ruleSet := GetActiveRuleSet()
+
+	for i := range pods {
+		pod := &pods[i]
+		if ruleSet.exemptionReason(pod.Namespace) != "" {
+			continue
+		}
+
+		missing := GetExtendResourceTolerationsToAdd(pod)
+		if len(missing) == 0 {
+			continue
+		}
+
+		workload := b.owners.resolveWorkload(podKind, &pod.ObjectMeta)
+		j, ok := index[workload]
+		if !ok {
+			j = len(results)
+			index[workload] = j
+			results = append(results, BackfillResult{Workload: workload})
+		}
+
+		result := &results[j]
+		result.Pods = append(result.Pods, pod.Name)
+		for _, toleration := range missing {
+			if !hasToleration(result.MissingTolerations, toleration) {
+				result.MissingTolerations = append(result.MissingTolerations, toleration)
+			}
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		x, y := results[i].Workload, results[j].Workload
+		if x.Namespace != y.Namespace {
+			return x.Namespace < y.Namespace
+		}
+		if x.Kind != y.Kind {
+			return x.Kind < y.Kind
+		}
+		return x.Name < y.Name
+	})
+
+	for i := range results {
+		result := &results[i]
+		recreate := nonReplacingWorkloads[result.Workload.Kind]
+		if _, ok := patchableWorkloads[result.Workload.Kind]; !ok {
+			result.Action = BackfillActionRecreate
+		} else if !b.patch || b.client == nil || b.dynamicClient == nil {
+			result.Action = BackfillActionPatch
+			if recreate {
+				result.Action = BackfillActionPatchRecreate
+			}
+		} else if err := b.patchWorkload(result); err != nil {
+			result.Action = BackfillActionFailed
+			result.Error = err.Error()
+		} else if recreate && result.Action == BackfillActionPatched {
+			result.Action = BackfillActionPatchedRecreate
+		} else if recreate {
+			result.Action = BackfillActionRecreate
+		}
+	}
+
+	return results
+}
+
+// patchWorkload adds the missing tolerations to the pod template of the
+// workload, with the patch the mutating webhook would return for it.
+func (b *Backfiller) patchWorkload(result *BackfillResult) error {
+	workload := result.Workload
+	resource := patchableWorkloads[workload.Kind]
+
+	object, err := b.getWorkload(workload)
+	if err != nil {
+		return err
+	}
+
+	template, err := getPodTemplate(&admissionv1.AdmissionRequest{
+		Name:      workload.Name,
+		Namespace: workload.Namespace,
+		Resource:  metav1.GroupVersionResource{Group: resource.Group, Resource: resource.Resource},
+		Object:    object,
+	})
+	if err != nil {
+		return err
+	}
+
+	tolerationsToAdd := GetExtendResourceTolerationsToAdd(&template.Pod)
+	if len(tolerationsToAdd) == 0 {
+		result.Action = BackfillActionUpToDate
+		return nil
+	}
+
+	patch, err := getTemplateTolerationsPatchData(template.Path, template.Pod, tolerationsToAdd)
+	if err != nil {
+		return err
+	}
+
+	if err := b.patchObject(workload, patch); err != nil {
+		return err
+	}
+
+	result.Action = BackfillActionPatched
+	return nil
+}
+
+func (b *Backfiller) getWorkload(workload WorkloadRef) (runtime.RawExtension, error) {
+	var object interface{}
+	var err error
+
+	switch workload.Kind {
+	case deploymentKind:
+		object, err = b.client.AppsV1().Deployments(workload.Namespace).Get(context.TODO(), workload.Name, metav1.GetOptions{})
+	case statefulSetKind:
+		object, err = b.client.AppsV1().StatefulSets(workload.Namespace).Get(context.TODO(), workload.Name, metav1.GetOptions{})
+	case daemonSetKind:
+		object, err = b.client.AppsV1().DaemonSets(workload.Namespace).Get(context.TODO(), workload.Name, metav1.GetOptions{})
+	case replicaSetKind:
+		object, err = b.client.AppsV1().ReplicaSets(workload.Namespace).Get(context.TODO(), workload.Name, metav1.GetOptions{})
+	case cronJobKind:
+		var resource schema.GroupVersionResource
+		if resource, err = getCronJobResource(b.client); err == nil {
+			object, err = b.dynamicClient.Resource(resource).Namespace(workload.Namespace).Get(context.TODO(), workload.Name, metav1.GetOptions{})
+		}
+	}
+	if apierrors.IsNotFound(err) {
+		return runtime.RawExtension{}, fmt.Errorf("%s not found", workload)
+	}
+	if err != nil {
+		return runtime.RawExtension{}, err
+	}
+
+	data, err := json.Marshal(object)
+	if err != nil {
+		return runtime.RawExtension{}, err
+	}
+
+	return runtime.RawExtension{Raw: data}, nil
+}
+
+func (b *Backfiller) patchObject(workload WorkloadRef, patch []byte) error {
+	var err error
+
+	switch workload.Kind {
+	case deploymentKind:
+		_, err = b.client.AppsV1().Deployments(workload.Namespace).Patch(context.TODO(), workload.Name, types.JSONPatchType, patch, metav1.PatchOptions{})
+	case statefulSetKind:
+		_, err = b.client.AppsV1().StatefulSets(workload.Namespace).Patch(context.TODO(), workload.Name, types.JSONPatchType, patch, metav1.PatchOptions{})
+	case daemonSetKind:
+		_, err = b.client.AppsV1().DaemonSets(workload.Namespace).Patch(context.TODO(), workload.Name, types.JSONPatchType, patch, metav1.PatchOptions{})
+	case replicaSetKind:
+		_, err = b.client.AppsV1().ReplicaSets(workload.Namespace).Patch(context.TODO(), workload.Name, types.JSONPatchType, patch, metav1.PatchOptions{})
+	case cronJobKind:
+		var resource schema.GroupVersionResource
+		if resource, err = getCronJobResource(b.client); err == nil {
+			_, err = b.dynamicClient.Resource(resource).Namespace(workload.Namespace).Patch(context.TODO(), workload.Name, types.JSONPatchType, patch, metav1.PatchOptions{})
+		}
+	}
+
+	return err
+}
+
+// WriteBackfillReport writes the results as a table.
+func WriteBackfillReport(w io.Writer, results []BackfillResult) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tWORKLOAD\tPODS\tMISSING TOLERATIONS\tACTION")
+
+	for _, result := range results {
+		var tolerations []string
+		for _, toleration := range result.MissingTolerations {
+			tolerations = append(tolerations, formatToleration(toleration))
+		}
+
+		action := result.Action
+		if result.Error != "" {
+			action += ": " + result.Error
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", result.Workload.Namespace, result.Workload, len(result.Pods), strings.Join(tolerations, ","), action)
+	}
+
+	return tw.Flush()
+}
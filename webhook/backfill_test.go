@@ -0,0 +1,301 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newOwnerReference(kind, name string) []metav1.OwnerReference {
+	controller := true
+	return []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &controller}}
+}
+
+// newBackfillObjects returns the objects of a namespace with GPU pods of a
+// Deployment, a StatefulSet, a Job and a bare pod lacking tolerations, as
+// well as a GPU pod carrying them and one of an exempt namespace.
+func newBackfillObjects(nvidia string) ([]corev1.Pod, []runtime.Object) {
+	gpuPod := func(namespace, name string, owners []metav1.OwnerReference, tolerations ...corev1.Toleration) corev1.Pod {
+		pod := newPodRequesting(nvidia, tolerations...)
+		pod.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"}
+		pod.ObjectMeta = metav1.ObjectMeta{Namespace: namespace, Name: name, OwnerReferences: owners}
+		return pod
+	}
+
+	pods := []corev1.Pod{
+		gpuPod("ml", "train-7d9f-a", newOwnerReference("ReplicaSet", "train-7d9f")),
+		gpuPod("ml", "train-7d9f-b", newOwnerReference("ReplicaSet", "train-7d9f")),
+		gpuPod("ml", "serve-0", newOwnerReference("StatefulSet", "serve")),
+		gpuPod("ml", "batch-x1", newOwnerReference("Job", "batch")),
+		gpuPod("ml", "notebook", nil),
+		gpuPod("ml", "tolerated", nil, getTolerationObject(nvidia)...),
+		gpuPod(controllerNameSpaceName, "device-plugin", nil),
+	}
+
+	template := corev1.PodTemplateSpec{Spec: newPodRequesting(nvidia).Spec}
+	objects := []runtime.Object{
+		&appsv1.Deployment{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ml", Name: "train"},
+			Spec:       appsv1.DeploymentSpec{Template: template},
+		},
+		&appsv1.ReplicaSet{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "ReplicaSet"},
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ml", Name: "train-7d9f", OwnerReferences: newOwnerReference("Deployment", "train")},
+			Spec:       appsv1.ReplicaSetSpec{Template: template},
+		},
+		&appsv1.StatefulSet{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "StatefulSet"},
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ml", Name: "serve"},
+			Spec:       appsv1.StatefulSetSpec{Template: template},
+		},
+		&batchv1.Job{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"},
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ml", Name: "batch"},
+			Spec:       batchv1.JobSpec{Template: template},
+		},
+	}
+	for i := range pods {
+		objects = append(objects, &pods[i])
+	}
+
+	return pods, objects
+}
+
+// newCronJob returns a CronJob of the given version with a GPU pod template
+// lacking tolerations.
+func newCronJob(t *testing.T, nvidia, version, namespace, name string) *unstructured.Unstructured {
+	template, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&corev1.PodTemplateSpec{Spec: newPodRequesting(nvidia).Spec})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "batch/" + version,
+		"kind":       "CronJob",
+		"metadata":   map[string]interface{}{"namespace": namespace, "name": name},
+		"spec": map[string]interface{}{
+			"schedule":    "@daily",
+			"jobTemplate": map[string]interface{}{"spec": map[string]interface{}{"template": template}},
+		},
+	}}
+}
+
+// serveCronJobs makes the discovery of the fake client report CronJobs in
+// the given versions of the batch group.
+func serveCronJobs(client *fake.Clientset, versions ...string) {
+	for _, version := range versions {
+		client.Resources = append(client.Resources, &metav1.APIResourceList{
+			GroupVersion: "batch/" + version,
+			APIResources: []metav1.APIResource{{Name: "cronjobs", Kind: "CronJob", Namespaced: true}},
+		})
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+	SetTargetResourcesSet(ArrayFlags{nvidia})
+
+	expected := []struct {
+		workload string
+		pods     int
+	}{
+		{"Deployment/train", 2},
+		{"Job/batch", 1},
+		{"Pod/notebook", 1},
+		{"StatefulSet/serve", 1},
+	}
+
+	tests := []struct {
+		description     string
+		patch           bool
+		expectedActions []string
+	}{
+		{"report only", false, []string{BackfillActionPatch, BackfillActionRecreate, BackfillActionRecreate, BackfillActionPatch}},
+		{"patch templates", true, []string{BackfillActionPatched, BackfillActionRecreate, BackfillActionRecreate, BackfillActionPatched}},
+	}
+
+	for _, test := range tests {
+		_, objects := newBackfillObjects(nvidia)
+		client := fake.NewSimpleClientset(objects...)
+		dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+
+		pods, err := NewBackfiller(client, dynamicClient, test.patch).ListPods("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		results := NewBackfiller(client, dynamicClient, test.patch).Reconcile(pods)
+
+		if len(results) != len(expected) {
+			t.Errorf("Test (%s) Failed: expected %d workloads, got %v", test.description, len(expected), results)
+			continue
+		}
+		for i, result := range results {
+			if result.Workload.String() != expected[i].workload || len(result.Pods) != expected[i].pods || result.Action != test.expectedActions[i] {
+				t.Errorf("Test (%s) Failed: expected %s with %d pods to %s, got %v", test.description, expected[i].workload, expected[i].pods, test.expectedActions[i], result)
+			}
+			if len(result.MissingTolerations) != len(DefaultTolerationEffects) {
+				t.Errorf("Test (%s) Failed: expected the tolerations of %s to be missing, got %v", test.description, nvidia, result.MissingTolerations)
+			}
+		}
+
+		deployment, err := client.AppsV1().Deployments("ml").Get(context.TODO(), "train", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if patched := len(deployment.Spec.Template.Spec.Tolerations) != 0; patched != test.patch {
+			t.Errorf("Test (%s) Failed: expected the deployment template to be patched %v, got %v", test.description, test.patch, deployment.Spec.Template.Spec.Tolerations)
+		}
+
+		if test.patch {
+			results = NewBackfiller(client, dynamicClient, test.patch).Reconcile(pods)
+			if results[0].Action != BackfillActionUpToDate {
+				t.Errorf("Test (%s) Failed: expected the patched deployment to be up to date, got %v", test.description, results[0])
+			}
+		}
+	}
+}
+
+func TestBackfillCronJob(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+	SetTargetResourcesSet(ArrayFlags{nvidia})
+
+	tests := []struct {
+		description    string
+		servedVersions []string
+		version        string
+		expectedAction string
+	}{
+		{"CronJob served in batch/v1, expect it to be patched and its running pods to be recreated", []string{"v1", "v1beta1"}, "v1", BackfillActionPatchedRecreate},
+		{"CronJob served in batch/v1beta1 only, expect it to be patched and its running pods to be recreated", []string{"v1beta1"}, "v1beta1", BackfillActionPatchedRecreate},
+		{"CronJob not served, expect the patch to fail", nil, "v1", BackfillActionFailed},
+	}
+
+	for _, test := range tests {
+		pod := newPodRequesting(nvidia)
+		pod.ObjectMeta = metav1.ObjectMeta{Namespace: "ml", Name: "nightly-1-x", OwnerReferences: newOwnerReference("Job", "nightly-1")}
+		job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: "ml", Name: "nightly-1", OwnerReferences: newOwnerReference("CronJob", "nightly")}}
+
+		client := fake.NewSimpleClientset(&pod, job)
+		serveCronJobs(client, test.servedVersions...)
+		dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), newCronJob(t, nvidia, test.version, "ml", "nightly"))
+
+		results := NewBackfiller(client, dynamicClient, true).Reconcile([]corev1.Pod{pod})
+		if len(results) != 1 || results[0].Workload.String() != "CronJob/nightly" || results[0].Action != test.expectedAction {
+			t.Errorf("Test (%s) Failed: expected CronJob/nightly to be %s, got %v", test.description, test.expectedAction, results)
+			continue
+		}
+
+		resource := schema.GroupVersionResource{Group: "batch", Version: test.version, Resource: "cronjobs"}
+		cronJob, err := dynamicClient.Resource(resource).Namespace("ml").Get(context.TODO(), "nightly", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tolerations, _, _ := unstructured.NestedSlice(cronJob.Object, "spec", "jobTemplate", "spec", "template", "spec", "tolerations")
+		if expected := test.expectedAction == BackfillActionPatchedRecreate; (len(tolerations) != 0) != expected {
+			t.Errorf("Test (%s) Failed: expected the template to be patched %v, got tolerations %v", test.description, expected, tolerations)
+		}
+
+		// The pods of the running Job keep lacking the tolerations.
+		if test.expectedAction == BackfillActionPatchedRecreate {
+			results = NewBackfiller(client, dynamicClient, true).Reconcile([]corev1.Pod{pod})
+			if len(results) != 1 || results[0].Action != BackfillActionRecreate {
+				t.Errorf("Test (%s) Failed: expected the pods of the patched CronJob to be recreated, got %v", test.description, results)
+			}
+		}
+	}
+}
+
+func TestBackfillStandaloneReplicaSet(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+	SetTargetResourcesSet(ArrayFlags{nvidia})
+
+	pod := newPodRequesting(nvidia)
+	pod.ObjectMeta = metav1.ObjectMeta{Namespace: "ml", Name: "workers-a", OwnerReferences: newOwnerReference("ReplicaSet", "workers")}
+	replicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ml", Name: "workers"},
+		Spec:       appsv1.ReplicaSetSpec{Template: corev1.PodTemplateSpec{Spec: newPodRequesting(nvidia).Spec}},
+	}
+	client := fake.NewSimpleClientset(&pod, replicaSet)
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+
+	// A ReplicaSet does not replace its pods when its template changes.
+	tests := []struct {
+		description    string
+		patch          bool
+		expectedAction string
+	}{
+		{"report only", false, BackfillActionPatchRecreate},
+		{"patch template", true, BackfillActionPatchedRecreate},
+		{"patched template", true, BackfillActionRecreate},
+	}
+
+	for _, test := range tests {
+		results := NewBackfiller(client, dynamicClient, test.patch).Reconcile([]corev1.Pod{pod})
+		if len(results) != 1 || results[0].Workload.String() != "ReplicaSet/workers" || results[0].Action != test.expectedAction {
+			t.Errorf("Test (%s) Failed: expected ReplicaSet/workers to be %s, got %v", test.description, test.expectedAction, results)
+		}
+	}
+}
+
+func TestBackfillPodListFile(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+	SetTargetResourcesSet(ArrayFlags{nvidia})
+
+	_, objects := newBackfillObjects(nvidia)
+	list := corev1.List{TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "List"}}
+	for _, object := range objects {
+		list.Items = append(list.Items, runtime.RawExtension{Object: object})
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pods.json")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	backfiller := NewBackfiller(nil, nil, true)
+	pods, err := backfiller.LoadPodListFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pods) != 7 {
+		t.Errorf("expected the 7 pods of the list, got %d", len(pods))
+	}
+
+	results := backfiller.Reconcile(pods)
+	if len(results) != 4 || results[0].Workload.String() != "Deployment/train" || results[0].Action != BackfillActionPatch {
+		t.Errorf("expected the owner of the ReplicaSet of the list to be reported without patching, got %v", results)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteBackfillReport(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 5 || !strings.Contains(lines[1], "Deployment/train") {
+		t.Errorf("expected a header and a line per workload, got\n%s", buf.String())
+	}
+}
@@ -0,0 +1,746 @@
+package webhook
+
+import (
+	"fmt"
+	"io/ioutil"
+	pathpkg "path"
+	"regexp"
+	"strings"
+
+	mapset "github.com/deckarep/golang-set"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	ConfigAPIVersion = "gpu-resource-toleration-admission-controller/v1alpha1"
+	ConfigKind       = "TolerationConfiguration"
+)
+
+// allTaintEffects is accepted in place of an effect name and stands for the
+// empty effect, which tolerates every taint effect.
+const allTaintEffects = "All"
+
+var supportedTaintEffects = []string{
+	string(corev1.TaintEffectNoSchedule),
+	string(corev1.TaintEffectPreferNoSchedule),
+	string(corev1.TaintEffectNoExecute),
+	allTaintEffects,
+}
+
+// DefaultTolerationEffects are the taint effects tolerated for a target
+// resource which is given without an explicit effect list.
+var DefaultTolerationEffects = []corev1.TaintEffect{
+	corev1.TaintEffectNoSchedule,
+	corev1.TaintEffectNoExecute,
+}
+
+// Config is the versioned configuration file of the admission controller.
+//
+//	apiVersion: gpu-resource-toleration-admission-controller/v1alpha1
+//	kind: TolerationConfiguration
+//	resources:
+//	- name: nvidia.com/gpu
+//	  effects: [NoSchedule, NoExecute]
+//	  tolerationSeconds: 3600
+//	- name: amd.com/gpu
+//	  tolerations:
+//	  - key: accelerator
+//	    operator: Equal
+//	    value: mi100
+//	    effect: NoSchedule
+//	groups:
+//	- name: nvidia-mig
+//	  resources: [nvidia.com/mig-*]
+//	  tolerations:
+//	  - key: nvidia.com/gpu
+//	    effect: NoSchedule
+type Config struct {
+	APIVersion string           `json:"apiVersion"`
+	Kind       string           `json:"kind"`
+	Resources  []ResourceConfig `json:"resources,omitempty"`
+	Groups     []ResourceGroup  `json:"groups,omitempty"`
+	// Enforcement is the enforcement mode of the rules which set none,
+	// defaults to the -enforcement flag.
+	Enforcement string `json:"enforcement,omitempty"`
+	// Namespaces selects the namespaces the rules apply to, all but
+	// kube-system by default.
+	Namespaces *NamespacePolicy `json:"namespaces,omitempty"`
+}
+
+// ResourceConfig configures the tolerations given to pods using an extended
+// resource. By default the tolerated taints are keyed by the resource name;
+// Tolerations maps the resource to taints with other keys instead.
+type ResourceConfig struct {
+	// Name is the extended resource name, e.g. nvidia.com/gpu, or a glob
+	// pattern matching a family of resources, e.g. nvidia.com/* or
+	// *.amd.com/gpu. A "*" does not match "/".
+	Name string `json:"name,omitempty"`
+	// NameRegex is a regular expression matching whole resource names, set
+	// in place of Name.
+	NameRegex string `json:"nameRegex,omitempty"`
+	// Effects are the taint effects to tolerate, one toleration per effect.
+	// "All" tolerates every effect. Defaults to NoSchedule and NoExecute.
+	Effects []string `json:"effects,omitempty"`
+	// TolerationSeconds is set on the NoExecute toleration, which bounds how
+	// long the pod stays on a node once the taint is added.
+	TolerationSeconds *int64 `json:"tolerationSeconds,omitempty"`
+	// Tolerations are added to pods using the resource in place of the
+	// tolerations built from the resource name and Effects.
+	Tolerations []TolerationTemplate `json:"tolerations,omitempty"`
+	// Taints are the taints of the nodes providing the resource. They are
+	// derived from the tolerations by default, with any value for a toleration
+	// with the Exists operator.
+	Taints []TaintTemplate `json:"taints,omitempty"`
+
+	// Enforcement overrides the enforcement mode of the configuration.
+	Enforcement string `json:"enforcement,omitempty"`
+	// Exemptions are the identities allowed to use the tolerations without
+	// requesting the resource.
+	Exemptions *Exemptions `json:"exemptions,omitempty"`
+
+	// flag is the -targetResource value this entry was parsed from, if any.
+	flag string
+}
+
+// ResourceGroup shares a set of tolerations between several resources, e.g.
+// MIG slices which are all scheduled on nodes carrying a single GPU taint.
+// Pods using any member get the group's tolerations once, and the validating
+// webhook allows them to pods using any member.
+type ResourceGroup struct {
+	Name string `json:"name"`
+	// Resources are the member resource names or glob patterns.
+	Resources []string `json:"resources,omitempty"`
+	// ResourceRegexes are regular expressions matching member resource names.
+	ResourceRegexes []string             `json:"resourceRegexes,omitempty"`
+	Tolerations     []TolerationTemplate `json:"tolerations"`
+	// Enforcement overrides the enforcement mode of the configuration.
+	Enforcement string `json:"enforcement,omitempty"`
+	// Exemptions are the identities allowed to use the tolerations without
+	// requesting a member.
+	Exemptions *Exemptions `json:"exemptions,omitempty"`
+}
+
+// EnforcementMode is the response of the validating webhook to a toleration
+// of the taint of a resource the pod does not use.
+type EnforcementMode string
+
+const (
+	// EnforcementEnforce denies the request.
+	EnforcementEnforce EnforcementMode = "Enforce"
+	// EnforcementWarn allows the request with a warning to the client.
+	EnforcementWarn EnforcementMode = "Warn"
+	// EnforcementAudit allows the request and only records the violation in
+	// the audit annotations.
+	EnforcementAudit EnforcementMode = "Audit"
+)
+
+var supportedEnforcementModes = []string{
+	string(EnforcementEnforce),
+	string(EnforcementWarn),
+	string(EnforcementAudit),
+}
+
+// severity orders the modes from Audit to Enforce.
+func (m EnforcementMode) severity() int {
+	switch m {
+	case EnforcementEnforce:
+		return 2
+	case EnforcementWarn:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// TolerationTemplate is a toleration to add to pods using a resource.
+type TolerationTemplate struct {
+	Key string `json:"key"`
+	// Operator is Equal or Exists. Defaults to Exists without a value and
+	// to Equal with one.
+	Operator string `json:"operator,omitempty"`
+	Value    string `json:"value,omitempty"`
+	// Effect is NoSchedule, PreferNoSchedule, NoExecute, or All (or empty)
+	// to tolerate every effect.
+	Effect            string `json:"effect,omitempty"`
+	TolerationSeconds *int64 `json:"tolerationSeconds,omitempty"`
+}
+
+// TaintTemplate is a taint of the nodes providing a resource.
+type TaintTemplate struct {
+	// Key defaults to the resource name, or the matched resource name for
+	// patterns.
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+	// Effect is NoSchedule, PreferNoSchedule or NoExecute.
+	Effect string `json:"effect"`
+}
+
+// TargetResource is a validated ResourceConfig. Pods using a resource matched
+// by Name or NameRegex get its tolerations. A toleration keyed by Name, or by
+// the empty key for NameRegex, tolerates the taint keyed by the matched
+// resource name.
+type TargetResource struct {
+	Name        string              `json:"name,omitempty"`
+	NameRegex   string              `json:"nameRegex,omitempty"`
+	Group       string              `json:"group,omitempty"`
+	Tolerations []corev1.Toleration `json:"tolerations"`
+	// Taints are the configured taints, nil to derive them from Tolerations.
+	Taints []corev1.Taint `json:"taints,omitempty"`
+	// Enforcement is the enforcement mode, empty for the -enforcement flag.
+	Enforcement EnforcementMode `json:"enforcement,omitempty"`
+	// Exemptions are the identities allowed to use the tolerations without
+	// requesting the resource.
+	Exemptions *Exemptions `json:"exemptions,omitempty"`
+}
+
+// Rule identifies the resource rule by its group, name or regular expression.
+func (r TargetResource) Rule() string {
+	if r.Group != "" {
+		return "group:" + r.Group
+	}
+
+	return r.matchExpression()
+}
+
+func (r TargetResource) matchExpression() string {
+	if r.NameRegex != "" {
+		return "regex:" + r.NameRegex
+	}
+
+	return r.Name
+}
+
+// TolerationsFor returns the tolerations for the given matched resource.
+func (r TargetResource) TolerationsFor(resourceName string) []corev1.Toleration {
+	var tolerations []corev1.Toleration
+
+	for _, toleration := range r.Tolerations {
+		if r.isResourceNameKey(toleration.Key) {
+			toleration.Key = resourceName
+		}
+		tolerations = append(tolerations, toleration)
+	}
+
+	return tolerations
+}
+
+// TaintKeys returns the configured taint keys tolerated for the resource,
+// leaving out the ones keyed by the matched resource name.
+func (r TargetResource) TaintKeys() []string {
+	var keys []string
+	seen := mapset.NewSet()
+
+	for _, toleration := range r.Tolerations {
+		if !r.isResourceNameKey(toleration.Key) && seen.Add(toleration.Key) {
+			keys = append(keys, toleration.Key)
+		}
+	}
+
+	return keys
+}
+
+// toleratesResourceName reports whether the resource tolerates taints keyed
+// by the matched resource name.
+func (r TargetResource) toleratesResourceName() bool {
+	for _, toleration := range r.Tolerations {
+		if r.isResourceNameKey(toleration.Key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r TargetResource) isResourceNameKey(key string) bool {
+	if r.NameRegex != "" {
+		return key == ""
+	}
+
+	return key == r.Name
+}
+
+// NewConfig returns an empty configuration of the current version.
+func NewConfig() *Config {
+	return &Config{APIVersion: ConfigAPIVersion, Kind: ConfigKind}
+}
+
+// LoadConfigFile reads a YAML or JSON configuration file. The returned
+// configuration is not validated yet.
+func LoadConfigFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %v", err)
+	}
+
+	config, err := ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse config file %s: %v", path, err)
+	}
+
+	return config, nil
+}
+
+// ParseConfig decodes a YAML or JSON configuration, rejecting unknown fields.
+func ParseConfig(data []byte) (*Config, error) {
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// AddTargetResourceFlags appends the resources given as -targetResource
+// flags, which are a shorthand for configuration file entries.
+func (c *Config) AddTargetResourceFlags(targetResourceFlags ArrayFlags) {
+	for _, value := range targetResourceFlags {
+		c.Resources = append(c.Resources, parseTargetResourceFlag(value))
+	}
+}
+
+// Validate checks the whole configuration and returns the target resources it
+// describes. Every problem found is reported with its field path.
+func (c *Config) Validate() ([]TargetResource, error) {
+	var allErrs field.ErrorList
+
+	if c.APIVersion != ConfigAPIVersion {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("apiVersion"), c.APIVersion, fmt.Sprintf("must be %s", ConfigAPIVersion)))
+	}
+	if c.Kind != ConfigKind {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("kind"), c.Kind, fmt.Sprintf("must be %s", ConfigKind)))
+	}
+
+	allErrs = append(allErrs, validateEnforcementMode(c.Enforcement, field.NewPath("enforcement"))...)
+	allErrs = append(allErrs, validateNamespacePolicy(c.Namespaces, field.NewPath("namespaces"))...)
+
+	var resources []TargetResource
+	expressions := mapset.NewSet()
+
+	addResource := func(resource TargetResource, path *field.Path) {
+		if resource.Enforcement == "" {
+			resource.Enforcement = EnforcementMode(c.Enforcement)
+		}
+
+		if resource.matchExpression() != "" && !expressions.Add(resource.matchExpression()) {
+			if resource.NameRegex != "" {
+				allErrs = append(allErrs, field.Duplicate(path, resource.NameRegex))
+			} else {
+				allErrs = append(allErrs, field.Duplicate(path, resource.Name))
+			}
+		}
+		resources = append(resources, resource)
+	}
+
+	for i, resourceConfig := range c.Resources {
+		path := field.NewPath("resources").Index(i)
+		if resourceConfig.flag != "" {
+			path = field.NewPath(fmt.Sprintf("-targetResource=%s", resourceConfig.flag))
+		}
+
+		resource, errs := validateResourceConfig(resourceConfig, path)
+		allErrs = append(allErrs, errs...)
+		allErrs = append(allErrs, validateEnforcementMode(resourceConfig.Enforcement, path.Child("enforcement"))...)
+		resource.Enforcement = EnforcementMode(resourceConfig.Enforcement)
+		allErrs = append(allErrs, validateExemptions(resourceConfig.Exemptions, path.Child("exemptions"))...)
+		resource.Exemptions = resourceConfig.Exemptions
+
+		if resource.NameRegex != "" {
+			addResource(resource, path.Child("nameRegex"))
+		} else {
+			addResource(resource, path.Child("name"))
+		}
+	}
+
+	groupNames := mapset.NewSet()
+	for i, group := range c.Groups {
+		path := field.NewPath("groups").Index(i)
+
+		if group.Name == "" {
+			allErrs = append(allErrs, field.Required(path.Child("name"), "group name must be set"))
+		} else if !groupNames.Add(group.Name) {
+			allErrs = append(allErrs, field.Duplicate(path.Child("name"), group.Name))
+		}
+
+		if len(group.Resources) == 0 && len(group.ResourceRegexes) == 0 {
+			allErrs = append(allErrs, field.Required(path.Child("resources"), "at least one member resource must be set"))
+		}
+
+		tolerations, errs := validateTolerationTemplates(group.Tolerations, path.Child("tolerations"))
+		allErrs = append(allErrs, errs...)
+		allErrs = append(allErrs, validateEnforcementMode(group.Enforcement, path.Child("enforcement"))...)
+		enforcement := EnforcementMode(group.Enforcement)
+		allErrs = append(allErrs, validateExemptions(group.Exemptions, path.Child("exemptions"))...)
+
+		for j, name := range group.Resources {
+			memberPath := path.Child("resources").Index(j)
+			allErrs = append(allErrs, validateNamePattern(name, memberPath)...)
+			addResource(TargetResource{Name: name, Group: group.Name, Tolerations: tolerations, Enforcement: enforcement, Exemptions: group.Exemptions}, memberPath)
+		}
+
+		for j, expr := range group.ResourceRegexes {
+			memberPath := path.Child("resourceRegexes").Index(j)
+			allErrs = append(allErrs, validateNameRegex(expr, memberPath)...)
+			addResource(TargetResource{NameRegex: expr, Group: group.Name, Tolerations: tolerations, Enforcement: enforcement, Exemptions: group.Exemptions}, memberPath)
+		}
+	}
+
+	if len(allErrs) != 0 {
+		return nil, allErrs.ToAggregate()
+	}
+
+	return resources, nil
+}
+
+// NewRuleSet validates the configuration and builds the rule set it
+// describes.
+func (c *Config) NewRuleSet() (*RuleSet, error) {
+	resources, err := c.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := c.Namespaces
+	if namespaces == nil {
+		namespaces = defaultNamespacePolicy()
+	}
+
+	return newRuleSet(resources, namespaces), nil
+}
+
+// ParseTargetResource parses and validates a -targetResource value of the form
+// "name[:effect[,effect...]]", e.g. "nvidia.com/gpu:NoSchedule,NoExecute".
+// Without an effect list DefaultTolerationEffects are used.
+func ParseTargetResource(value string) (TargetResource, error) {
+	resource, errs := validateResourceConfig(parseTargetResourceFlag(value), field.NewPath(fmt.Sprintf("-targetResource=%s", value)))
+	if len(errs) != 0 {
+		return TargetResource{}, errs.ToAggregate()
+	}
+
+	return resource, nil
+}
+
+func parseTargetResourceFlag(value string) ResourceConfig {
+	resourceConfig := ResourceConfig{Name: value, flag: value}
+
+	if i := strings.Index(value, ":"); i >= 0 {
+		resourceConfig.Name = value[:i]
+		resourceConfig.Effects = strings.Split(value[i+1:], ",")
+	}
+
+	resourceConfig.Name = strings.TrimSpace(resourceConfig.Name)
+	for i, effect := range resourceConfig.Effects {
+		resourceConfig.Effects[i] = strings.TrimSpace(effect)
+	}
+
+	return resourceConfig
+}
+
+func validateResourceConfig(resourceConfig ResourceConfig, path *field.Path) (TargetResource, field.ErrorList) {
+	var allErrs field.ErrorList
+
+	allErrs = append(allErrs, validateResourceName(resourceConfig, path)...)
+
+	if resourceConfig.Tolerations != nil {
+		if resourceConfig.Effects != nil {
+			allErrs = append(allErrs, field.Forbidden(path.Child("effects"), "may not be set together with tolerations"))
+		}
+		if resourceConfig.TolerationSeconds != nil {
+			allErrs = append(allErrs, field.Forbidden(path.Child("tolerationSeconds"), "may not be set together with tolerations, set it on the NoExecute toleration instead"))
+		}
+
+		tolerations, errs := validateTolerationTemplates(resourceConfig.Tolerations, path.Child("tolerations"))
+		allErrs = append(allErrs, errs...)
+
+		return validateResourceTaints(resourceConfig, tolerations, path, allErrs)
+	}
+
+	effects := DefaultTolerationEffects
+	if resourceConfig.Effects != nil {
+		var errs field.ErrorList
+		effects, errs = validateTaintEffects(resourceConfig.Effects, path.Child("effects"))
+		allErrs = append(allErrs, errs...)
+	}
+
+	if resourceConfig.TolerationSeconds != nil {
+		secondsPath := path.Child("tolerationSeconds")
+
+		if *resourceConfig.TolerationSeconds < 0 {
+			allErrs = append(allErrs, field.Invalid(secondsPath, *resourceConfig.TolerationSeconds, "must be greater than or equal to 0"))
+		}
+		if !containsTaintEffect(effects, corev1.TaintEffectNoExecute) {
+			allErrs = append(allErrs, field.Invalid(secondsPath, *resourceConfig.TolerationSeconds, "requires the NoExecute effect"))
+		}
+	}
+
+	// Keyed by Name, or by the empty key for NameRegex, which both stand for
+	// the matched resource name.
+	var tolerations []corev1.Toleration
+	for _, effect := range effects {
+		toleration := corev1.Toleration{
+			Key:      resourceConfig.Name,
+			Operator: corev1.TolerationOpExists,
+			Effect:   effect,
+		}
+
+		if effect == corev1.TaintEffectNoExecute {
+			toleration.TolerationSeconds = resourceConfig.TolerationSeconds
+		}
+
+		tolerations = append(tolerations, toleration)
+	}
+
+	return validateResourceTaints(resourceConfig, tolerations, path, allErrs)
+}
+
+// validateResourceTaints builds the target resource with its configured
+// taints, each of which has to be tolerated by one of its tolerations.
+func validateResourceTaints(resourceConfig ResourceConfig, tolerations []corev1.Toleration, path *field.Path, allErrs field.ErrorList) (TargetResource, field.ErrorList) {
+	resource := TargetResource{Name: resourceConfig.Name, NameRegex: resourceConfig.NameRegex, Tolerations: tolerations}
+	if resourceConfig.Taints == nil {
+		return resource, allErrs
+	}
+
+	taintsPath := path.Child("taints")
+	if len(resourceConfig.Taints) == 0 {
+		allErrs = append(allErrs, field.Required(taintsPath, "at least one taint must be set"))
+	}
+
+	resource.Taints = []corev1.Taint{}
+	for i, template := range resourceConfig.Taints {
+		idxPath := taintsPath.Index(i)
+		taint := corev1.Taint{Key: template.Key, Value: template.Value, Effect: corev1.TaintEffect(template.Effect)}
+
+		// Keyed by Name, or by the empty key for NameRegex, like the
+		// tolerations derived from the effects.
+		if taint.Key == "" {
+			taint.Key = resourceConfig.Name
+		} else {
+			for _, msg := range validation.IsQualifiedName(taint.Key) {
+				allErrs = append(allErrs, field.Invalid(idxPath.Child("key"), taint.Key, msg))
+			}
+		}
+
+		for _, msg := range validation.IsValidLabelValue(taint.Value) {
+			allErrs = append(allErrs, field.Invalid(idxPath.Child("value"), taint.Value, msg))
+		}
+
+		switch taint.Effect {
+		case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		default:
+			allErrs = append(allErrs, field.NotSupported(idxPath.Child("effect"), template.Effect,
+				[]string{string(corev1.TaintEffectNoSchedule), string(corev1.TaintEffectPreferNoSchedule), string(corev1.TaintEffectNoExecute)}))
+		}
+
+		for _, existing := range resource.Taints {
+			if existing.Key == taint.Key && existing.Effect == taint.Effect {
+				allErrs = append(allErrs, field.Duplicate(idxPath, template))
+				break
+			}
+		}
+
+		if !toleratesTaint(tolerations, guardedTaint{Taint: taint}) {
+			allErrs = append(allErrs, field.Invalid(idxPath, template, "is not tolerated by any toleration of the resource"))
+		}
+
+		resource.Taints = append(resource.Taints, taint)
+	}
+
+	return resource, allErrs
+}
+
+// validateResourceName checks that exactly one of a resource name, a glob
+// pattern or a regular expression is set.
+func validateResourceName(resourceConfig ResourceConfig, path *field.Path) field.ErrorList {
+	switch {
+	case resourceConfig.Name != "" && resourceConfig.NameRegex != "":
+		return field.ErrorList{field.Forbidden(path.Child("nameRegex"), "may not be set together with name")}
+	case resourceConfig.NameRegex != "":
+		return validateNameRegex(resourceConfig.NameRegex, path.Child("nameRegex"))
+	case resourceConfig.Name == "":
+		return field.ErrorList{field.Required(path.Child("name"), "resource name or nameRegex must be set")}
+	default:
+		return validateNamePattern(resourceConfig.Name, path.Child("name"))
+	}
+}
+
+// validateNamePattern checks a resource name or glob pattern.
+func validateNamePattern(name string, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if isGlobPattern(name) {
+		if _, err := pathpkg.Match(name, ""); err != nil {
+			allErrs = append(allErrs, field.Invalid(path, name, err.Error()))
+		}
+		return allErrs
+	}
+
+	for _, msg := range validation.IsQualifiedName(name) {
+		allErrs = append(allErrs, field.Invalid(path, name, msg))
+	}
+
+	return allErrs
+}
+
+func validateNameRegex(expr string, path *field.Path) field.ErrorList {
+	if expr == "" {
+		return field.ErrorList{field.Required(path, "regular expression must be set")}
+	}
+
+	if _, err := compileNameRegex(expr); err != nil {
+		return field.ErrorList{field.Invalid(path, expr, err.Error())}
+	}
+
+	return nil
+}
+
+func isGlobPattern(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// compileNameRegex compiles a regular expression which has to match the whole
+// resource name.
+func compileNameRegex(expr string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// validateTolerationTemplates converts templates into tolerations, checking
+// them like the apiserver checks pod tolerations.
+func validateTolerationTemplates(templates []TolerationTemplate, path *field.Path) ([]corev1.Toleration, field.ErrorList) {
+	var allErrs field.ErrorList
+	var tolerations []corev1.Toleration
+
+	if len(templates) == 0 {
+		allErrs = append(allErrs, field.Required(path, "at least one toleration must be set"))
+	}
+
+	for i, template := range templates {
+		idxPath := path.Index(i)
+		toleration := corev1.Toleration{
+			Key:               template.Key,
+			Operator:          corev1.TolerationOperator(template.Operator),
+			Value:             template.Value,
+			TolerationSeconds: template.TolerationSeconds,
+		}
+
+		if template.Key == "" {
+			allErrs = append(allErrs, field.Required(idxPath.Child("key"), "taint key must be set"))
+		} else {
+			for _, msg := range validation.IsQualifiedName(template.Key) {
+				allErrs = append(allErrs, field.Invalid(idxPath.Child("key"), template.Key, msg))
+			}
+		}
+
+		if toleration.Operator == "" {
+			toleration.Operator = corev1.TolerationOpExists
+			if template.Value != "" {
+				toleration.Operator = corev1.TolerationOpEqual
+			}
+		}
+
+		switch toleration.Operator {
+		case corev1.TolerationOpEqual:
+			for _, msg := range validation.IsValidLabelValue(template.Value) {
+				allErrs = append(allErrs, field.Invalid(idxPath.Child("value"), template.Value, msg))
+			}
+		case corev1.TolerationOpExists:
+			if template.Value != "" {
+				allErrs = append(allErrs, field.Invalid(idxPath.Child("value"), template.Value, "must be empty when operator is Exists"))
+			}
+		default:
+			allErrs = append(allErrs, field.NotSupported(idxPath.Child("operator"), template.Operator,
+				[]string{string(corev1.TolerationOpEqual), string(corev1.TolerationOpExists)}))
+		}
+
+		if template.Effect != "" {
+			effect, ok := parseTaintEffect(template.Effect)
+			if !ok {
+				allErrs = append(allErrs, field.NotSupported(idxPath.Child("effect"), template.Effect, supportedTaintEffects))
+			}
+			toleration.Effect = effect
+		}
+
+		if template.TolerationSeconds != nil {
+			if *template.TolerationSeconds < 0 {
+				allErrs = append(allErrs, field.Invalid(idxPath.Child("tolerationSeconds"), *template.TolerationSeconds, "must be greater than or equal to 0"))
+			}
+			if toleration.Effect != corev1.TaintEffectNoExecute {
+				allErrs = append(allErrs, field.Invalid(idxPath.Child("tolerationSeconds"), *template.TolerationSeconds, "requires the NoExecute effect"))
+			}
+		}
+
+		for _, existing := range tolerations {
+			if isSameToleration(existing, toleration) {
+				allErrs = append(allErrs, field.Duplicate(idxPath, template))
+				break
+			}
+		}
+
+		tolerations = append(tolerations, toleration)
+	}
+
+	return tolerations, allErrs
+}
+
+// validateEnforcementMode checks an optional enforcement mode.
+func validateEnforcementMode(value string, path *field.Path) field.ErrorList {
+	switch EnforcementMode(value) {
+	case "", EnforcementEnforce, EnforcementWarn, EnforcementAudit:
+		return nil
+	default:
+		return field.ErrorList{field.NotSupported(path, value, supportedEnforcementModes)}
+	}
+}
+
+// validateTaintEffects converts effect names into taint effects, rejecting
+// unknown and duplicated effects. "All" maps to the empty effect.
+func validateTaintEffects(values []string, path *field.Path) ([]corev1.TaintEffect, field.ErrorList) {
+	var allErrs field.ErrorList
+	var effects []corev1.TaintEffect
+
+	if len(values) == 0 {
+		allErrs = append(allErrs, field.Required(path, "at least one effect must be set"))
+	}
+
+	seen := mapset.NewSet()
+	for i, value := range values {
+		effect, ok := parseTaintEffect(value)
+		if !ok || value == "" {
+			allErrs = append(allErrs, field.NotSupported(path.Index(i), value, supportedTaintEffects))
+			continue
+		}
+
+		if !seen.Add(effect) {
+			allErrs = append(allErrs, field.Duplicate(path.Index(i), value))
+			continue
+		}
+		effects = append(effects, effect)
+	}
+
+	return effects, allErrs
+}
+
+// parseTaintEffect converts an effect name into a taint effect. "All" and
+// the empty name map to the empty effect.
+func parseTaintEffect(value string) (corev1.TaintEffect, bool) {
+	switch value {
+	case string(corev1.TaintEffectNoSchedule), string(corev1.TaintEffectPreferNoSchedule), string(corev1.TaintEffectNoExecute):
+		return corev1.TaintEffect(value), true
+	case allTaintEffects, "":
+		return "", true
+	default:
+		return "", false
+	}
+}
+
+func containsTaintEffect(effects []corev1.TaintEffect, effect corev1.TaintEffect) bool {
+	for _, e := range effects {
+		if e == effect {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,374 @@
+package webhook
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	seconds := int64(3600)
+
+	tests := []struct {
+		description       string
+		data              string
+		flags             ArrayFlags
+		expected          []TargetResource
+		expectedErrorsHas []string
+	}{
+		{
+			description: "yaml config with defaults and explicit effects",
+			data: `
+apiVersion: gpu-resource-toleration-admission-controller/v1alpha1
+kind: TolerationConfiguration
+resources:
+- name: nvidia.com/gpu
+- name: xilinx.com/fpga
+  effects: [NoSchedule, NoExecute]
+  tolerationSeconds: 3600
+- name: rdma/hca
+  effects: [All]
+`,
+			expected: []TargetResource{
+				{Name: "nvidia.com/gpu", Tolerations: newExistsTolerations("nvidia.com/gpu", DefaultTolerationEffects...)},
+				{Name: "xilinx.com/fpga", Tolerations: []corev1.Toleration{
+					{Key: "xilinx.com/fpga", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule},
+					{Key: "xilinx.com/fpga", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoExecute, TolerationSeconds: &seconds},
+				}},
+				{Name: "rdma/hca", Tolerations: newExistsTolerations("rdma/hca", "")},
+			},
+		},
+		{
+			description: "json config merged with target resource flags",
+			data:        `{"apiVersion": "gpu-resource-toleration-admission-controller/v1alpha1", "kind": "TolerationConfiguration", "resources": [{"name": "nvidia.com/gpu", "effects": ["NoSchedule"]}]}`,
+			flags:       ArrayFlags{"amd.com/gpu:PreferNoSchedule"},
+			expected: []TargetResource{
+				{Name: "nvidia.com/gpu", Tolerations: newExistsTolerations("nvidia.com/gpu", corev1.TaintEffectNoSchedule)},
+				{Name: "amd.com/gpu", Tolerations: newExistsTolerations("amd.com/gpu", corev1.TaintEffectPreferNoSchedule)},
+			},
+		},
+		{
+			description: "resources mapped to differently named taint keys",
+			data: `
+apiVersion: gpu-resource-toleration-admission-controller/v1alpha1
+kind: TolerationConfiguration
+resources:
+- name: nvidia.com/gpu
+  tolerations:
+  - key: gpu-node
+    value: "true"
+    effect: NoSchedule
+  - key: accelerator
+    operator: Exists
+    effect: NoExecute
+    tolerationSeconds: 3600
+- name: amd.com/gpu
+  tolerations:
+  - key: accelerator
+`,
+			expected: []TargetResource{
+				{Name: "nvidia.com/gpu", Tolerations: []corev1.Toleration{
+					{Key: "gpu-node", Operator: corev1.TolerationOpEqual, Value: "true", Effect: corev1.TaintEffectNoSchedule},
+					{Key: "accelerator", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoExecute, TolerationSeconds: &seconds},
+				}},
+				{Name: "amd.com/gpu", Tolerations: []corev1.Toleration{
+					{Key: "accelerator", Operator: corev1.TolerationOpExists},
+				}},
+			},
+		},
+		{
+			description: "invalid toleration templates, expect every error with its field path",
+			data: `
+apiVersion: gpu-resource-toleration-admission-controller/v1alpha1
+kind: TolerationConfiguration
+resources:
+- name: nvidia.com/gpu
+  effects: [NoSchedule]
+  tolerations:
+  - operator: Exists
+    value: a100
+  - key: gpu-node
+    operator: In
+    effect: NoSchedule
+    tolerationSeconds: 10
+  - key: gpu-node
+    operator: In
+    effect: NoSchedule
+`,
+			expectedErrorsHas: []string{
+				`resources[0].effects: Forbidden: may not be set together with tolerations`,
+				`resources[0].tolerations[0].key: Required value`,
+				`resources[0].tolerations[0].value: Invalid value: "a100": must be empty when operator is Exists`,
+				`resources[0].tolerations[1].operator: Unsupported value: "In"`,
+				`resources[0].tolerations[1].tolerationSeconds: Invalid value: 10: requires the NoExecute effect`,
+				`resources[0].tolerations[2]: Duplicate value`,
+			},
+		},
+		{
+			description: "invalid resource patterns, expect every error with its field path",
+			data: `
+apiVersion: gpu-resource-toleration-admission-controller/v1alpha1
+kind: TolerationConfiguration
+resources:
+- name: nvidia.com/[mig
+- nameRegex: nvidia.com/(mig
+- name: nvidia.com/*
+  nameRegex: nvidia.com/.*
+- nameRegex: amd.com/.*
+- nameRegex: amd.com/.*
+`,
+			expectedErrorsHas: []string{
+				`resources[0].name: Invalid value: "nvidia.com/[mig": syntax error in pattern`,
+				`resources[1].nameRegex: Invalid value: "nvidia.com/(mig"`,
+				`resources[2].nameRegex: Forbidden: may not be set together with name`,
+				`resources[4].nameRegex: Duplicate value: "amd.com/.*"`,
+			},
+		},
+		{
+			description: "invalid resource groups, expect every error with its field path",
+			data: `
+apiVersion: gpu-resource-toleration-admission-controller/v1alpha1
+kind: TolerationConfiguration
+resources:
+- name: nvidia.com/mig-1g.5gb
+groups:
+- name: nvidia-mig
+  resources: [nvidia.com/mig-1g.5gb]
+  resourceRegexes: ["nvidia.com/(mig"]
+  tolerations:
+  - key: nvidia.com/gpu
+- name: nvidia-mig
+  tolerations: []
+`,
+			expectedErrorsHas: []string{
+				`groups[0].resources[0]: Duplicate value: "nvidia.com/mig-1g.5gb"`,
+				`groups[0].resourceRegexes[0]: Invalid value: "nvidia.com/(mig"`,
+				`groups[1].name: Duplicate value: "nvidia-mig"`,
+				`groups[1].resources: Required value`,
+				`groups[1].tolerations: Required value`,
+			},
+		},
+		{
+			description: "configured taints keyed by the resource name by default",
+			data: `
+apiVersion: gpu-resource-toleration-admission-controller/v1alpha1
+kind: TolerationConfiguration
+resources:
+- name: nvidia.com/gpu
+  effects: [NoSchedule]
+  taints:
+  - value: present
+    effect: NoSchedule
+`,
+			expected: []TargetResource{
+				{
+					Name:        "nvidia.com/gpu",
+					Tolerations: newExistsTolerations("nvidia.com/gpu", corev1.TaintEffectNoSchedule),
+					Taints: []corev1.Taint{
+						{Key: "nvidia.com/gpu", Value: "present", Effect: corev1.TaintEffectNoSchedule},
+					},
+				},
+			},
+		},
+		{
+			description: "invalid taints, expect every error with its field path",
+			data: `
+apiVersion: gpu-resource-toleration-admission-controller/v1alpha1
+kind: TolerationConfiguration
+resources:
+- name: nvidia.com/gpu
+  taints:
+  - effect: All
+  - value: "not a value"
+    effect: NoExecute
+  - effect: NoExecute
+  - key: accelerator
+    effect: NoSchedule
+- name: amd.com/gpu
+  taints: []
+`,
+			expectedErrorsHas: []string{
+				`resources[0].taints[0].effect: Unsupported value: "All"`,
+				`resources[0].taints[1].value: Invalid value: "not a value"`,
+				`resources[0].taints[2]: Duplicate value`,
+				`resources[0].taints[3]: Invalid value`,
+				`is not tolerated by any toleration of the resource`,
+				`resources[1].taints: Required value`,
+			},
+		},
+		{
+			description: "invalid enforcement modes, expect every error with its field path",
+			data: `
+apiVersion: gpu-resource-toleration-admission-controller/v1alpha1
+kind: TolerationConfiguration
+enforcement: enforce
+resources:
+- name: nvidia.com/gpu
+  enforcement: Block
+groups:
+- name: nvidia-mig
+  resources: [nvidia.com/mig-*]
+  tolerations:
+  - key: nvidia.com/gpu
+  enforcement: Audit
+`,
+			expectedErrorsHas: []string{
+				`enforcement: Unsupported value: "enforce"`,
+				`resources[0].enforcement: Unsupported value: "Block"`,
+			},
+		},
+		{
+			description: "unknown field, expect strict decoding error",
+			data: `
+apiVersion: gpu-resource-toleration-admission-controller/v1alpha1
+kind: TolerationConfiguration
+resources:
+- name: nvidia.com/gpu
+  effect: NoSchedule
+`,
+			expectedErrorsHas: []string{`unknown field "effect"`},
+		},
+		{
+			description: "wrong version and invalid resources, expect every error with its field path",
+			data: `
+apiVersion: v1
+kind: TolerationConfiguration
+resources:
+- name: nvidia.com/gpu
+  effects: [NoSchedule, NoRun, NoSchedule]
+- name: amd.com/gpu
+  effects: [NoSchedule]
+  tolerationSeconds: 60
+- name: ""
+- name: nvidia.com/gpu
+`,
+			expectedErrorsHas: []string{
+				`apiVersion: Invalid value: "v1"`,
+				`resources[0].effects[1]: Unsupported value: "NoRun"`,
+				`resources[0].effects[2]: Duplicate value: "NoSchedule"`,
+				`resources[1].tolerationSeconds: Invalid value: 60: requires the NoExecute effect`,
+				`resources[2].name: Required value`,
+				`resources[3].name: Duplicate value: "nvidia.com/gpu"`,
+			},
+		},
+		{
+			description: "flag duplicating a config entry, expect error naming the flag",
+			data: `
+apiVersion: gpu-resource-toleration-admission-controller/v1alpha1
+kind: TolerationConfiguration
+resources:
+- name: nvidia.com/gpu
+`,
+			flags:             ArrayFlags{"nvidia.com/gpu:NoSchedule"},
+			expectedErrorsHas: []string{`-targetResource=nvidia.com/gpu:NoSchedule.name: Duplicate value: "nvidia.com/gpu"`},
+		},
+		{
+			description: "invalid exemptions, expect every error with its field path",
+			data: `
+apiVersion: gpu-resource-toleration-admission-controller/v1alpha1
+kind: TolerationConfiguration
+resources:
+- name: nvidia.com/gpu
+  exemptions:
+    users: [""]
+    serviceAccounts: [nvidia-device-plugin, gpu-operator/Device_Plugin]
+groups:
+- name: nvidia-mig
+  resources: [nvidia.com/mig-*]
+  tolerations:
+  - key: nvidia.com/gpu
+  exemptions:
+    groups: [""]
+`,
+			expectedErrorsHas: []string{
+				`resources[0].exemptions.users[0]: Required value`,
+				`resources[0].exemptions.serviceAccounts[0]: Invalid value: "nvidia-device-plugin": must be <namespace>/<name> or <namespace>/*`,
+				`resources[0].exemptions.serviceAccounts[1]: Invalid value: "gpu-operator/Device_Plugin"`,
+				`groups[0].exemptions.groups[0]: Required value`,
+			},
+		},
+		{
+			description: "invalid namespace policy, expect every error with its field path",
+			data: `
+apiVersion: gpu-resource-toleration-admission-controller/v1alpha1
+kind: TolerationConfiguration
+resources:
+- name: nvidia.com/gpu
+namespaces:
+  include: [Team_A]
+  selector:
+    matchExpressions:
+    - key: gpu
+      operator: Has
+  labels:
+    team-a:
+      gpu: "not a value"
+`,
+			expectedErrorsHas: []string{
+				`namespaces.include[0]: Invalid value: "Team_A"`,
+				`namespaces.selector: Invalid value`,
+				`namespaces.labels[team-a][gpu]: Invalid value: "not a value"`,
+			},
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range tests {
+		path := filepath.Join(dir, "config.yaml")
+		if err := ioutil.WriteFile(path, []byte(test.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		resources, err := func() ([]TargetResource, error) {
+			config, err := LoadConfigFile(path)
+			if err != nil {
+				return nil, err
+			}
+			config.AddTargetResourceFlags(test.flags)
+			return config.Validate()
+		}()
+
+		if len(test.expectedErrorsHas) != 0 {
+			if err == nil {
+				t.Errorf("Test (%s) Failed: expected error, got %v", test.description, resources)
+				continue
+			}
+			for _, expected := range test.expectedErrorsHas {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("Test (%s) Failed: expected error to contain %q, got %q", test.description, expected, err.Error())
+				}
+			}
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(resources, test.expected) {
+			t.Errorf("Test (%s) Failed: expected %v, got %v (err: %v)", test.description, test.expected, resources, err)
+		}
+	}
+}
+
+func TestTolerationSecondsOnlyOnNoExecute(t *testing.T) {
+	seconds := int64(600)
+	resource, errs := validateResourceConfig(ResourceConfig{Name: "nvidia.com/gpu", TolerationSeconds: &seconds}, nil)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	for _, toleration := range resource.Tolerations {
+		hasSeconds := toleration.TolerationSeconds != nil && *toleration.TolerationSeconds == seconds
+
+		if hasSeconds != (toleration.Effect == corev1.TaintEffectNoExecute) {
+			t.Errorf("unexpected tolerationSeconds on %s toleration: %v", toleration.Effect, toleration.TolerationSeconds)
+		}
+	}
+}
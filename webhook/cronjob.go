@@ -0,0 +1,35 @@
+package webhook
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+)
+
+// cronJobVersions are the versions of the batch group CronJobs are served in,
+// preferred first. batch/v1 is served since Kubernetes 1.21, and
+// batch/v1beta1 no longer since 1.25. The typed client only knows the latter,
+// so CronJobs are read and patched with the dynamic client.
+var cronJobVersions = []string{"v1", "v1beta1"}
+
+// getCronJobResource returns the resource of CronJobs in the first of their
+// versions the server serves.
+func getCronJobResource(client kubernetes.Interface) (schema.GroupVersionResource, error) {
+	for _, version := range cronJobVersions {
+		resource := schema.GroupVersionResource{Group: "batch", Version: version, Resource: "cronjobs"}
+
+		// A group version which is not served is reported as an error.
+		resources, err := client.Discovery().ServerResourcesForGroupVersion(resource.GroupVersion().String())
+		if err != nil {
+			continue
+		}
+		for _, apiResource := range resources.APIResources {
+			if apiResource.Name == resource.Resource {
+				return resource, nil
+			}
+		}
+	}
+
+	return schema.GroupVersionResource{}, fmt.Errorf("CronJobs are not served in any of the versions %v of the batch group", cronJobVersions)
+}
@@ -0,0 +1,135 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// serviceAccountUsernamePrefix prefixes the username of service accounts,
+// followed by "<namespace>:<name>".
+const serviceAccountUsernamePrefix = "system:serviceaccount:"
+
+// Exemptions allow identities to use the tolerations of a resource without
+// requesting it, e.g. node agents like a device plugin or a metrics exporter
+// which run on every node providing the resource. Users, groups and the
+// service accounts sending requests only exempt pods, the pod templates of
+// workloads are only exempt through the service account of their pods.
+type Exemptions struct {
+	// Users are the exempt usernames of requests.
+	Users []string `json:"users,omitempty"`
+	// Groups are the exempt groups of the users of requests.
+	Groups []string `json:"groups,omitempty"`
+	// ServiceAccounts are the exempt service accounts as "<namespace>/<name>",
+	// or "<namespace>/*" for every service account of the namespace. They
+	// match requests by service accounts, as well as pods running as one.
+	ServiceAccounts []string `json:"serviceAccounts,omitempty"`
+}
+
+// requester identifies who requests an object and which service account its
+// pods run as.
+type requester struct {
+	username string
+	groups   []string
+	// namespace and serviceAccountName identify the service account of the
+	// pod, empty when the pod does not set one.
+	namespace          string
+	serviceAccountName string
+}
+
+// newRequester returns the requester of the admission request of the pod. The
+// pods of a workload are created by its controller rather than by the user
+// applying the workload, so only the service account of a pod template can
+// exempt it: exempting the user would admit a workload whose pods are denied.
+func newRequester(req *admissionv1.AdmissionRequest, template *podTemplate) *requester {
+	namespace := template.Pod.Namespace
+	if namespace == "" {
+		namespace = req.Namespace
+	}
+
+	r := &requester{
+		namespace:          namespace,
+		serviceAccountName: template.Pod.Spec.ServiceAccountName,
+	}
+	if !template.isTemplate() {
+		r.username = req.UserInfo.Username
+		r.groups = req.UserInfo.Groups
+	}
+
+	return r
+}
+
+func validateExemptions(exemptions *Exemptions, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if exemptions == nil {
+		return allErrs
+	}
+
+	for i, user := range exemptions.Users {
+		if user == "" {
+			allErrs = append(allErrs, field.Required(path.Child("users").Index(i), "username must be set"))
+		}
+	}
+	for i, group := range exemptions.Groups {
+		if group == "" {
+			allErrs = append(allErrs, field.Required(path.Child("groups").Index(i), "group must be set"))
+		}
+	}
+
+	for i, serviceAccount := range exemptions.ServiceAccounts {
+		idxPath := path.Child("serviceAccounts").Index(i)
+
+		parts := strings.Split(serviceAccount, "/")
+		if len(parts) != 2 {
+			allErrs = append(allErrs, field.Invalid(idxPath, serviceAccount, "must be <namespace>/<name> or <namespace>/*"))
+			continue
+		}
+		for _, msg := range validation.IsDNS1123Label(parts[0]) {
+			allErrs = append(allErrs, field.Invalid(idxPath, serviceAccount, msg))
+		}
+		if parts[1] != "*" {
+			for _, msg := range validation.IsDNS1123Subdomain(parts[1]) {
+				allErrs = append(allErrs, field.Invalid(idxPath, serviceAccount, msg))
+			}
+		}
+	}
+
+	return allErrs
+}
+
+// exemptionReason returns why the requester is exempt from the rule, or an
+// empty string if it is not.
+func (r TargetResource) exemptionReason(requester *requester) string {
+	if r.Exemptions == nil || requester == nil {
+		return ""
+	}
+
+	if containsString(r.Exemptions.Users, requester.username) {
+		return fmt.Sprintf("user %s is exempt from %s", requester.username, r.Rule())
+	}
+	for _, group := range requester.groups {
+		if containsString(r.Exemptions.Groups, group) {
+			return fmt.Sprintf("group %s is exempt from %s", group, r.Rule())
+		}
+	}
+
+	if strings.HasPrefix(requester.username, serviceAccountUsernamePrefix) {
+		parts := strings.Split(strings.TrimPrefix(requester.username, serviceAccountUsernamePrefix), ":")
+		if len(parts) == 2 && r.Exemptions.exemptsServiceAccount(parts[0], parts[1]) {
+			return fmt.Sprintf("service account %s/%s is exempt from %s", parts[0], parts[1], r.Rule())
+		}
+	}
+	if requester.serviceAccountName != "" && r.Exemptions.exemptsServiceAccount(requester.namespace, requester.serviceAccountName) {
+		return fmt.Sprintf("pod service account %s/%s is exempt from %s", requester.namespace, requester.serviceAccountName, r.Rule())
+	}
+
+	return ""
+}
+
+func (e *Exemptions) exemptsServiceAccount(namespace, name string) bool {
+	return containsString(e.ServiceAccounts, namespace+"/"+name) || containsString(e.ServiceAccounts, namespace+"/*")
+}
@@ -0,0 +1,110 @@
+package webhook
+
+import (
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestExemptions(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+	amd := "amd.com/gpu"
+	mig := "nvidia.com/mig-1g.5gb"
+
+	config := NewConfig()
+	config.Resources = []ResourceConfig{
+		{Name: nvidia, Exemptions: &Exemptions{
+			Users:           []string{"admin"},
+			Groups:          []string{"gpu-admins"},
+			ServiceAccounts: []string{"gpu-operator/nvidia-device-plugin", "monitoring/*"},
+		}},
+		{Name: amd},
+	}
+	config.Groups = []ResourceGroup{
+		{Name: "nvidia-mig", Resources: []string{mig}, Tolerations: []TolerationTemplate{{Key: "mig"}}, Exemptions: &Exemptions{Users: []string{"admin"}}},
+	}
+	resources, err := config.Validate()
+	if err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	SetTargetResources(resources)
+
+	tolerate := func(key string) corev1.Toleration {
+		return corev1.Toleration{Key: key, Operator: corev1.TolerationOpExists}
+	}
+	runningAs := func(serviceAccountName string, tolerations ...corev1.Toleration) corev1.Pod {
+		pod := newPodRequesting("", tolerations...)
+		pod.Spec.ServiceAccountName = serviceAccountName
+		return pod
+	}
+
+	cases := []struct {
+		description string
+		namespace   string
+		userInfo    authenticationv1.UserInfo
+		pod         corev1.Pod
+		allowed     bool
+		exemption   string
+	}{
+		{"An exempt user tolerating Nvidia GPU", "default", authenticationv1.UserInfo{Username: "admin"}, runningAs("", tolerate(nvidia)), true,
+			"user admin is exempt from nvidia.com/gpu"},
+		{"A user of an exempt group tolerating Nvidia GPU", "default", authenticationv1.UserInfo{Username: "alice", Groups: []string{"developers", "gpu-admins"}}, runningAs("", tolerate(nvidia)), true,
+			"group gpu-admins is exempt from nvidia.com/gpu"},
+		{"An exempt service account tolerating Nvidia GPU", "gpu-operator", authenticationv1.UserInfo{Username: "system:serviceaccount:gpu-operator:nvidia-device-plugin"}, runningAs("", tolerate(nvidia)), true,
+			"service account gpu-operator/nvidia-device-plugin is exempt from nvidia.com/gpu"},
+		{"A pod running as an exempt service account tolerating Nvidia GPU", "gpu-operator", authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:daemon-set-controller"}, runningAs("nvidia-device-plugin", tolerate(nvidia)), true,
+			"pod service account gpu-operator/nvidia-device-plugin is exempt from nvidia.com/gpu"},
+		{"A pod running as a service account of an exempt namespace tolerating Nvidia GPU", "monitoring", authenticationv1.UserInfo{Username: "alice"}, runningAs("dcgm-exporter", tolerate(nvidia)), true,
+			"pod service account monitoring/dcgm-exporter is exempt from nvidia.com/gpu"},
+		{"A pod running as a service account of the same name in another namespace", "default", authenticationv1.UserInfo{Username: "alice"}, runningAs("nvidia-device-plugin", tolerate(nvidia)), false, ""},
+		{"An exempt user tolerating AMD GPU, which has no exemptions", "default", authenticationv1.UserInfo{Username: "admin"}, runningAs("", tolerate(amd)), false, ""},
+		{"An exempt user tolerating every taint, including AMD GPU", "default", authenticationv1.UserInfo{Username: "admin"}, runningAs("", corev1.Toleration{Operator: corev1.TolerationOpExists}), false, ""},
+		{"An exempt user tolerating the taint of a group", "default", authenticationv1.UserInfo{Username: "admin"}, runningAs("", tolerate("mig")), true,
+			"user admin is exempt from group:nvidia-mig"},
+		{"A user tolerating Nvidia GPU", "default", authenticationv1.UserInfo{Username: "alice"}, runningAs("", tolerate(nvidia)), false, ""},
+	}
+
+	for _, c := range cases {
+		t.Logf("\tTest: %v", c.description)
+		req := &admissionv1.AdmissionRequest{Namespace: c.namespace, UserInfo: c.userInfo, Resource: podResource, Object: runtime.RawExtension{Raw: marshal(c.pod)}}
+		result, err := validateExtendResources(req)
+
+		exemption := result.auditAnnotations[exemptionAnnotationKey]
+		if (err == nil) != c.allowed || exemption != c.exemption {
+			t.Errorf("\t%s\tunexpected result: got %v with exemption %q, want allowed %v with exemption %q", failed, err, exemption, c.allowed, c.exemption)
+		} else {
+			t.Logf("\t%s\treturned: %v %q.", succeed, err, exemption)
+		}
+	}
+
+	// The pods of a workload are created by its controller, so only the
+	// service account of its pod template exempts it.
+	templateCases := []struct {
+		description string
+		userInfo    authenticationv1.UserInfo
+		pod         corev1.Pod
+		allowed     bool
+	}{
+		{"An exempt user applying a deployment tolerating Nvidia GPU", authenticationv1.UserInfo{Username: "admin"}, runningAs("", tolerate(nvidia)), false},
+		{"A user of an exempt group applying a deployment tolerating Nvidia GPU", authenticationv1.UserInfo{Username: "alice", Groups: []string{"gpu-admins"}}, runningAs("", tolerate(nvidia)), false},
+		{"An exempt service account applying a deployment tolerating Nvidia GPU", authenticationv1.UserInfo{Username: "system:serviceaccount:gpu-operator:nvidia-device-plugin"}, runningAs("", tolerate(nvidia)), false},
+		{"A deployment of pods running as an exempt service account tolerating Nvidia GPU", authenticationv1.UserInfo{Username: "alice"}, runningAs("nvidia-device-plugin", tolerate(nvidia)), true},
+	}
+
+	for _, c := range templateCases {
+		t.Logf("\tTest: %v", c.description)
+		req := newWorkloadRequest(t, "apps", "v1", "deployments", c.pod)
+		req.Namespace = "gpu-operator"
+		req.UserInfo = c.userInfo
+		_, err := validateExtendResources(req)
+
+		if (err == nil) != c.allowed {
+			t.Errorf("\t%s\tunexpected result: got %v, want allowed %v", failed, err, c.allowed)
+		} else {
+			t.Logf("\t%s\treturned: %v.", succeed, err)
+		}
+	}
+}
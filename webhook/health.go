@@ -0,0 +1,88 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// ReadinessCheck is a condition for the webhook server to receive admission
+// requests, reported by /readyz under its name.
+type ReadinessCheck struct {
+	Name string
+	// Check returns why the webhook server is not ready, nil if it is.
+	Check func() error
+}
+
+// CertificateCheck fails when the key pair holds no certificate, or when its
+// certificate is not valid yet or has expired.
+func CertificateCheck(keyPair tls.Certificate) ReadinessCheck {
+	return ReadinessCheck{
+		Name: "certificate",
+		Check: func() error {
+			if len(keyPair.Certificate) == 0 {
+				return fmt.Errorf("no certificate loaded")
+			}
+
+			certificate, err := x509.ParseCertificate(keyPair.Certificate[0])
+			if err != nil {
+				return fmt.Errorf("could not parse certificate: %v", err)
+			}
+
+			now := time.Now()
+			if now.Before(certificate.NotBefore) {
+				return fmt.Errorf("certificate is not valid before %s", certificate.NotBefore.Format(time.RFC3339))
+			}
+			if now.After(certificate.NotAfter) {
+				return fmt.Errorf("certificate expired at %s", certificate.NotAfter.Format(time.RFC3339))
+			}
+
+			return nil
+		},
+	}
+}
+
+// HandleHealthz reports that the webhook server is alive, which it is as long
+// as it answers.
+func HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := w.Write([]byte("ok")); err != nil {
+		klog.Errorf("Could not write response: %v", err)
+	}
+}
+
+// readyzHandler reports the result of every check, with status 503 Service
+// Unavailable when any fails.
+func readyzHandler(checks []ReadinessCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		ready := true
+
+		for _, check := range checks {
+			if err := check.Check(); err != nil {
+				ready = false
+				fmt.Fprintf(&buf, "[-]%s failed: %v\n", check.Name, err)
+			} else {
+				fmt.Fprintf(&buf, "[+]%s ok\n", check.Name)
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if ready {
+			buf.WriteString("readyz check passed\n")
+		} else {
+			klog.Warningf("Readiness check failed:\n%s", buf.String())
+			buf.WriteString("readyz check failed\n")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			klog.Errorf("Could not write response: %v", err)
+		}
+	}
+}
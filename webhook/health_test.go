@@ -0,0 +1,85 @@
+package webhook
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newKeyPair returns a self-signed key pair valid from notBefore to notAfter.
+func newKeyPair(t *testing.T, notBefore, notAfter time.Time) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gpu-resource-toleration-admission-controller.kube-system.svc"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{certificate}, PrivateKey: key}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	now := time.Now()
+	validKeyPair := newKeyPair(t, now.Add(-time.Hour), now.Add(time.Hour))
+	expiredKeyPair := newKeyPair(t, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	futureKeyPair := newKeyPair(t, now.Add(time.Hour), now.Add(2*time.Hour))
+
+	var configErr error
+	configCheck := ReadinessCheck{Name: "config", Check: func() error { return configErr }}
+
+	tests := []struct {
+		description    string
+		keyPair        tls.Certificate
+		configErr      error
+		expectedStatus int
+		expectedBody   []string
+	}{
+		{"valid certificate and config, expect ready", validKeyPair, nil, http.StatusOK, []string{"[+]certificate ok", "[+]config ok", "readyz check passed"}},
+		{"no certificate, expect not ready", tls.Certificate{}, nil, http.StatusServiceUnavailable, []string{"[-]certificate failed: no certificate loaded", "[+]config ok"}},
+		{"expired certificate, expect not ready", expiredKeyPair, nil, http.StatusServiceUnavailable, []string{"[-]certificate failed: certificate expired", "readyz check failed"}},
+		{"certificate not valid yet, expect not ready", futureKeyPair, nil, http.StatusServiceUnavailable, []string{"[-]certificate failed: certificate is not valid before"}},
+		{"invalid config, expect not ready", validKeyPair, fmt.Errorf("invalid config file"), http.StatusServiceUnavailable, []string{"[+]certificate ok", "[-]config failed: invalid config file"}},
+	}
+
+	for _, test := range tests {
+		configErr = test.configErr
+		handler := GetAdmissionWebhookServer(test.keyPair, 8443, configCheck).Handler
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if rr.Code != test.expectedStatus {
+			t.Errorf("Test (%s) Failed: expected status %d, got %d: %s", test.description, test.expectedStatus, rr.Code, rr.Body.String())
+		}
+		for _, expected := range test.expectedBody {
+			if !strings.Contains(rr.Body.String(), expected) {
+				t.Errorf("Test (%s) Failed: expected %q in the response, got %s", test.description, expected, rr.Body.String())
+			}
+		}
+
+		// The server is alive whether it is ready or not.
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if rr.Code != http.StatusOK || rr.Body.String() != "ok" {
+			t.Errorf("Test (%s) Failed: expected /healthz to answer ok, got %d: %s", test.description, rr.Code, rr.Body.String())
+		}
+	}
+}
@@ -30,49 +30,103 @@ func (i *ArrayFlags) Set(value string) error {
 	return nil
 }
 
-var targetResourcesSet mapset.Set
+func SetTargetResourcesSet(targetResourceFlags ArrayFlags) error {
+	config := NewConfig()
+	config.AddTargetResourceFlags(targetResourceFlags)
 
-func SetTargetResourcesSet(targetResources ArrayFlags) {
-	targetResourcesSet = mapset.NewSet()
-
-	for _, resource := range targetResources {
-		targetResourcesSet.Add(resource)
+	ruleSet, err := config.NewRuleSet()
+	if err != nil {
+		return err
 	}
+
+	SetActiveRuleSet(ruleSet)
+	return nil
+}
+
+func SetTargetResources(resources []TargetResource) {
+	SetActiveRuleSet(NewRuleSet(resources))
+}
+
+// GetTargetResource returns the rule matching the given resource name.
+func GetTargetResource(resourceName string) (TargetResource, bool) {
+	return GetActiveRuleSet().Match(resourceName)
 }
 
+// GetTargetResourcesSet returns the target resources configured by exact name.
 func GetTargetResourcesSet() *mapset.Set {
-	return &targetResourcesSet
+	return &GetActiveRuleSet().names
+}
+
+// GetEffectiveResourceRequests returns the resource amounts that the scheduler
+// will account for the given container. A resource counts when it appears in
+// either requests or limits. When both are set the request wins, otherwise
+// the limit is used, which mirrors the apiserver defaulting requests from
+// limits after admission. A zero amount does not count as using the resource.
+func GetEffectiveResourceRequests(resources corev1.ResourceRequirements) corev1.ResourceList {
+	effectiveRequests := corev1.ResourceList{}
+
+	for resourceName, quantity := range resources.Limits {
+		effectiveRequests[resourceName] = quantity
+	}
+
+	for resourceName, quantity := range resources.Requests {
+		effectiveRequests[resourceName] = quantity
+	}
+
+	return effectiveRequests
 }
 
 func GetExtendResourcesUsedByPod(pod *corev1.Pod) *mapset.Set {
 	extenedResourceSetUsedByPod := mapset.NewSet()
-	targetResourcesSet := GetTargetResourcesSet()
 
-	for _, container := range pod.Spec.Containers {
-		for resourceName := range container.Resources.Requests {
-			if (*targetResourcesSet).Contains(string(resourceName)) {
-				extenedResourceSetUsedByPod.Add(string(resourceName))
+	for resourceName := range GetMatchedRules(pod) {
+		extenedResourceSetUsedByPod.Add(resourceName)
+	}
+
+	return &extenedResourceSetUsedByPod
+}
+
+// GetMatchedRules returns the target resources used by the pod, mapped to the
+// rule each of them matched. Resources are collected from every container list
+// of the pod spec, including ephemeral containers, and from the pod overhead.
+func GetMatchedRules(pod *corev1.Pod) map[string]TargetResource {
+	matchedRules := make(map[string]TargetResource)
+	ruleSet := GetActiveRuleSet()
+
+	addUsedResources := func(resources corev1.ResourceList) {
+		for resourceName, quantity := range resources {
+			if quantity.IsZero() {
+				continue
+			}
+
+			if resource, ok := ruleSet.Match(string(resourceName)); ok {
+				matchedRules[string(resourceName)] = resource
 			}
 		}
 	}
 
+	for _, container := range pod.Spec.Containers {
+		addUsedResources(GetEffectiveResourceRequests(container.Resources))
+	}
 	for _, container := range pod.Spec.InitContainers {
-		for resourceName := range container.Resources.Requests {
-			if (*targetResourcesSet).Contains(string(resourceName)) {
-				extenedResourceSetUsedByPod.Add(string(resourceName))
-			}
-		}
+		addUsedResources(GetEffectiveResourceRequests(container.Resources))
+	}
+	for _, container := range pod.Spec.EphemeralContainers {
+		addUsedResources(GetEffectiveResourceRequests(container.Resources))
 	}
+	addUsedResources(pod.Spec.Overhead)
 
-	return &extenedResourceSetUsedByPod
+	return matchedRules
 }
 
+// GetExtendResourceTolerationsUsedByPod returns the taint keys of target
+// resources which are tolerated by the pod.
 func GetExtendResourceTolerationsUsedByPod(pod *corev1.Pod) *mapset.Set {
 	extenedResourceTolerationsSetUsedByPod := mapset.NewSet()
-	targetResourcesSet := GetTargetResourcesSet()
+	ruleSet := GetActiveRuleSet()
 
 	for _, toleration := range pod.Spec.Tolerations {
-		if (*targetResourcesSet).Contains(toleration.Key) {
+		if ruleSet.isTargetTaintKey(toleration.Key) {
 			extenedResourceTolerationsSetUsedByPod.Add(toleration.Key)
 		}
 	}
@@ -80,23 +134,202 @@ func GetExtendResourceTolerationsUsedByPod(pod *corev1.Pod) *mapset.Set {
 	return &extenedResourceTolerationsSetUsedByPod
 }
 
-func GetExtendResourceTolerationsToAdd(pod *corev1.Pod) *mapset.Set {
-	newTolerations := GetExtendResourcesUsedByPod(pod)
-	alreadySetExtendResourceTolerations := GetExtendResourceTolerationsUsedByPod(pod)
+// GetForbiddenTolerations returns the keyed tolerations of the pod which
+// tolerate a taint of a target resource, while no resource used by the pod
+// tolerates that taint. Tolerations and taints are matched by key, operator,
+// value and effect the way the scheduler does.
+func GetForbiddenTolerations(pod *corev1.Pod) []corev1.Toleration {
+	var forbiddenTolerations []corev1.Toleration
+
+	violations, _ := getTolerationViolations(pod, nil)
+	for _, violation := range violations {
+		if !violation.isWildcard() {
+			forbiddenTolerations = append(forbiddenTolerations, violation.toleration)
+		}
+	}
+
+	return forbiddenTolerations
+}
+
+// GetWildcardTolerations returns the tolerations of the pod without a key,
+// which tolerate every taint key, that tolerate a taint of a target resource
+// the pod does not use. Taints are matched the way the scheduler does, so a
+// toleration restricted to another effect is not returned.
+func GetWildcardTolerations(pod *corev1.Pod) []corev1.Toleration {
+	var wildcardTolerations []corev1.Toleration
 
-	for toleration := range (*newTolerations).Iter() {
-		if (*alreadySetExtendResourceTolerations).Contains(toleration) {
-			(*newTolerations).Remove(toleration)
+	violations, _ := getTolerationViolations(pod, nil)
+	for _, violation := range violations {
+		if violation.isWildcard() {
+			wildcardTolerations = append(wildcardTolerations, violation.toleration)
 		}
 	}
 
-	return newTolerations
+	return wildcardTolerations
+}
+
+// tolerationViolation is a toleration of the pod which tolerates a taint of a
+// target resource the pod does not use.
+type tolerationViolation struct {
+	// index is the index of the toleration in the pod spec.
+	index      int
+	toleration corev1.Toleration
+	// taint is a taint tolerated without using its resource.
+	taint guardedTaint
+}
+
+func (v tolerationViolation) isWildcard() bool {
+	return v.toleration.Key == ""
+}
+
+// message explains the violation, naming the resource the pod would have to
+// request.
+func (v tolerationViolation) message() string {
+	tolerated := "tolerates taint"
+	if v.isWildcard() {
+		tolerated = "has no key, so it tolerates every taint key including taint"
+	}
+
+	return fmt.Sprintf("toleration %s %s %s of extended resource %s, which is not requested by any container",
+		formatToleration(v.toleration), tolerated, v.taint.ToString(), v.taint.resourceDescription())
+}
+
+func formatToleration(toleration corev1.Toleration) string {
+	formatted := fmt.Sprintf("key=%q operator=%q", toleration.Key, toleration.Operator)
+	if toleration.Value != "" {
+		formatted += fmt.Sprintf(" value=%q", toleration.Value)
+	}
+	if toleration.Effect != "" {
+		formatted += fmt.Sprintf(" effect=%q", toleration.Effect)
+	}
+
+	return "{" + formatted + "}"
+}
+
+// getTolerationViolations returns a violation per toleration of the pod which
+// tolerates a taint of a target resource the pod does not use, unless the
+// requester is exempt from the rule of the taint. The reasons of the
+// exemptions which allowed a toleration are returned as well.
+func getTolerationViolations(pod *corev1.Pod, requester *requester) ([]tolerationViolation, []string) {
+	var violations []tolerationViolation
+	var exemptions []string
+	ruleSet := GetActiveRuleSet()
+	requiredTolerations, _ := getRequiredTolerations(pod)
+
+	for i, toleration := range pod.Spec.Tolerations {
+		var violation *tolerationViolation
+		var reasons []string
+
+		// Report the taint of the rule with the strictest enforcement mode.
+		for _, taint := range ruleSet.taintsToleratedBy(toleration) {
+			if toleratesTaint(requiredTolerations, taint) {
+				continue
+			}
+			if reason := taint.resource.exemptionReason(requester); reason != "" {
+				reasons = append(reasons, reason)
+				continue
+			}
+			if violation == nil || taint.resource.enforcementMode().severity() > violation.taint.resource.enforcementMode().severity() {
+				violation = &tolerationViolation{index: i, toleration: toleration, taint: taint}
+			}
+		}
+
+		if violation != nil {
+			violations = append(violations, *violation)
+			continue
+		}
+		for _, reason := range reasons {
+			if !containsString(exemptions, reason) {
+				exemptions = append(exemptions, reason)
+			}
+		}
+	}
+
+	return violations, exemptions
+}
+
+// GetExtendResourceTolerationsToAdd returns the tolerations required by the
+// extended resources used by the pod which the pod does not carry yet. A
+// toleration is already carried when one with the same key, operator, value
+// and effect exists, or when the tolerations of the pod tolerate every taint
+// it tolerates, so applying the result is idempotent.
+func GetExtendResourceTolerationsToAdd(pod *corev1.Pod) []corev1.Toleration {
+	var tolerationsToAdd []corev1.Toleration
+	_, taints := getRequiredTolerations(pod)
+
+	for _, toleration := range getTolerationObjects(GetExtendResourcesUsedByPod(pod)) {
+		if !hasToleration(pod.Spec.Tolerations, toleration) && !toleratesTaintsOf(pod.Spec.Tolerations, toleration, taints) {
+			tolerationsToAdd = append(tolerationsToAdd, toleration)
+		}
+	}
+
+	return tolerationsToAdd
+}
+
+// toleratesTaintsOf reports whether the tolerations tolerate every one of the
+// taints the toleration tolerates, and it tolerates at least one. Tolerations
+// without a key are not counted, so that pods carry the tolerations of their
+// resources even when they tolerate every taint.
+func toleratesTaintsOf(tolerations []corev1.Toleration, toleration corev1.Toleration, taints []guardedTaint) bool {
+	var keyedTolerations []corev1.Toleration
+	for _, existing := range tolerations {
+		if existing.Key != "" {
+			keyedTolerations = append(keyedTolerations, existing)
+		}
+	}
+	tolerations = keyedTolerations
+
+	tolerated := false
+
+	for _, taint := range taints {
+		if !tolerates(toleration, taint) {
+			continue
+		}
+		if !toleratesTaint(tolerations, taint) {
+			return false
+		}
+		tolerated = true
+	}
+
+	return tolerated
+}
+
+func hasToleration(tolerations []corev1.Toleration, toleration corev1.Toleration) bool {
+	for _, existing := range tolerations {
+		if isSameToleration(existing, toleration) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isSameToleration compares key, operator, value and effect. An empty
+// operator is equivalent to Equal.
+func isSameToleration(a, b corev1.Toleration) bool {
+	return a.Key == b.Key &&
+		normalizeTolerationOperator(a.Operator) == normalizeTolerationOperator(b.Operator) &&
+		a.Value == b.Value &&
+		a.Effect == b.Effect
+}
+
+func normalizeTolerationOperator(operator corev1.TolerationOperator) corev1.TolerationOperator {
+	if operator == "" {
+		return corev1.TolerationOpEqual
+	}
+
+	return operator
 }
 
-func GetAdmissionWebhookServer(keyPair tls.Certificate, port int) *http.Server {
+// GetAdmissionWebhookServer returns the webhook server serving the key pair.
+// /readyz checks the certificate of the key pair, then the given checks.
+func GetAdmissionWebhookServer(keyPair tls.Certificate, port int, checks ...ReadinessCheck) *http.Server {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/mutate", HandleMutate)
 	mux.HandleFunc("/validate", HandleValidate)
+	mux.HandleFunc("/config", HandleConfig)
+	mux.HandleFunc("/healthz", HandleHealthz)
+	mux.HandleFunc("/readyz", readyzHandler(append([]ReadinessCheck{CertificateCheck(keyPair)}, checks...)))
 
 	webhookServer := &http.Server{
 		Addr:      fmt.Sprintf(":%d", port),
@@ -6,6 +6,8 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sort"
+	"strings"
 
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -17,8 +19,27 @@ import (
 
 const (
 	controllerNameSpaceName string = "kube-system"
+
+	// matchedRulesAnnotationKey is the audit annotation listing the rule
+	// matched by each target resource used by the pod.
+	matchedRulesAnnotationKey = "matched-rules"
+
+	// exemptionAnnotationKey is the audit annotation explaining why the rules
+	// do not apply to the request.
+	exemptionAnnotationKey = "exemption"
 )
 
+// mutatePodTemplates enables patching the pod templates of workloads, see
+// SetMutatePodTemplates.
+var mutatePodTemplates bool
+
+// SetMutatePodTemplates sets whether the pod templates of workloads are patched
+// as well. Otherwise only pods are patched, and a workload shows the
+// tolerations only on the pods it creates.
+func SetMutatePodTemplates(enabled bool) {
+	mutatePodTemplates = enabled
+}
+
 type PatchOps struct {
 	// https://kubernetes.io/blog/2019/03/21/a-guide-to-kubernetes-admission-controllers/
 	Op    string      `json:"op"`
@@ -48,8 +69,7 @@ func HandleMutate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var admissionResponse *admissionv1.AdmissionResponse
-	ar := admissionv1.AdmissionReview{}
-	_, _, err := Deserializer.Decode(body, nil, &ar)
+	ar, gvk, err := decodeAdmissionReview(body)
 	if err != nil {
 		log.Printf("Can't decode body: %s\n", err)
 		admissionResponse = &admissionv1.AdmissionResponse{
@@ -57,22 +77,23 @@ func HandleMutate(w http.ResponseWriter, r *http.Request) {
 				Message: err.Error(),
 			},
 		}
-	} else {
-		admissionResponse = mutate(&ar)
-	}
-
-	admissionReview := admissionv1.AdmissionReview{}
-	if admissionResponse != nil {
-		admissionReview.Response = admissionResponse
-		if ar.Request != nil {
-			admissionReview.Response.UID = ar.Request.UID
+	} else if ar.Request == nil {
+		log.Println("Malformed admission review: request is nil")
+		admissionResponse = &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: "malformed admission review: request is nil",
+			},
 		}
+	} else {
+		admissionResponse = mutate(ar)
+		admissionResponse.UID = ar.Request.UID
 	}
 
-	resp, err := json.Marshal(admissionReview)
+	resp, err := encodeAdmissionReview(gvk, admissionResponse)
 	if err != nil {
 		log.Printf("Couldn't encode response: %s\n", err)
 		http.Error(w, fmt.Sprintf("couldn't encode response: %s", err), http.StatusInternalServerError)
+		return
 	}
 
 	klog.Infof("Writing response...")
@@ -87,8 +108,26 @@ func HandleMutate(w http.ResponseWriter, r *http.Request) {
 func mutate(ar *admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
 	req := ar.Request
 
-	var pod corev1.Pod
-	err := json.Unmarshal(req.Object.Raw, &pod)
+	// Tolerations can not be changed through subresources such as
+	// pods/ephemeralcontainers, so there is nothing to patch.
+	if req.SubResource != "" {
+		log.Printf("No need to mutate subresource %s, Pod name: %s/%s\n", req.SubResource, req.Name, req.Namespace)
+
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	if reason := GetActiveRuleSet().exemptionReason(req.Namespace); reason != "" {
+		log.Printf("No need to mutate, %s, name: %s/%s\n", reason, req.Name, req.Namespace)
+
+		return &admissionv1.AdmissionResponse{
+			Allowed:          true,
+			AuditAnnotations: map[string]string{exemptionAnnotationKey: reason},
+		}
+	}
+
+	template, err := getPodTemplate(req)
 	if err != nil {
 		klog.Errorf("Could not unmarshal raw object: %s", err)
 		return &admissionv1.AdmissionResponse{
@@ -97,18 +136,36 @@ func mutate(ar *admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
 			},
 		}
 	}
+	if template == nil {
+		log.Printf("No need to mutate %s, name: %s/%s\n", req.Kind.Kind, req.Name, req.Namespace)
+
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+	pod := template.Pod
 
-	tolerationsToAdd := GetExtendResourcesUsedByPod(&pod)
+	tolerationsToAdd := GetExtendResourceTolerationsToAdd(&pod)
 
-	if (*tolerationsToAdd).Cardinality() == 0 {
+	var auditAnnotations map[string]string
+	if matchedRules := getMatchedRulesAnnotation(&pod); matchedRules != "" {
+		auditAnnotations = map[string]string{matchedRulesAnnotationKey: matchedRules}
+	}
+
+	// Unless enabled, only pods are patched, the tolerations are added when
+	// the pods of a workload are created. Pods are only patched on creation,
+	// as the containers of a running pod can not change the resources they
+	// request, and so are immutable pod templates such as the ones of Jobs.
+	if len(tolerationsToAdd) == 0 || (template.isTemplate() && !mutatePodTemplates) || ((!template.isTemplate() || template.Immutable) && req.Operation == admissionv1.Update) {
 		log.Printf("No need to mutate, Pod name: %s/%s\n", pod.Name, pod.Namespace)
 
 		return &admissionv1.AdmissionResponse{
-			Allowed: true,
+			Allowed:          true,
+			AuditAnnotations: auditAnnotations,
 		}
 	}
 
-	patchData, err := getTolerationsPatchData(pod, tolerationsToAdd)
+	patchData, err := getTemplateTolerationsPatchData(template.Path, pod, tolerationsToAdd)
 
 	if err != nil {
 		log.Printf("Could not make patch data: %s\n", err)
@@ -119,10 +176,11 @@ func mutate(ar *admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
 		}
 	}
 
-	log.Printf("AdmissionResponse: patch=%s\n", string(patchData))
+	log.Printf("AdmissionResponse: matched rules=%s, patch=%s\n", auditAnnotations[matchedRulesAnnotationKey], string(patchData))
 	return &admissionv1.AdmissionResponse{
-		Allowed: true,
-		Patch:   patchData,
+		Allowed:          true,
+		AuditAnnotations: auditAnnotations,
+		Patch:            patchData,
 		PatchType: func() *admissionv1.PatchType {
 			patchType := admissionv1.PatchTypeJSONPatch
 			return &patchType
@@ -130,50 +188,84 @@ func mutate(ar *admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
 	}
 }
 
-func getTolerationsPatchData(pod corev1.Pod, tolerationsToAdd *mapset.Set) ([]byte, error) {
+// getTolerationsPatchData returns the minimal JSON patch adding the given
+// tolerations to the pod. Existing tolerations are never replaced, new ones are
+// appended one by one so that tolerations added by other webhooks in the chain
+// are preserved.
+func getTolerationsPatchData(pod corev1.Pod, tolerationsToAdd []corev1.Toleration) ([]byte, error) {
+	return getTemplateTolerationsPatchData("", pod, tolerationsToAdd)
+}
+
+// getTemplateTolerationsPatchData is getTolerationsPatchData for the pod
+// template found at the given JSON pointer, empty for pods themselves.
+func getTemplateTolerationsPatchData(templatePath string, pod corev1.Pod, tolerationsToAdd []corev1.Toleration) ([]byte, error) {
 	var patch []PatchOps
+	tolerationsPath := templatePath + "/spec/tolerations"
 
 	if pod.Spec.Tolerations == nil {
 		patch = append(patch, PatchOps{
 			Op:    "add",
-			Path:  "/spec/tolerations",
-			Value: getTolerationObjects(tolerationsToAdd),
+			Path:  tolerationsPath,
+			Value: tolerationsToAdd,
 		})
 	} else {
-		for v := range (*tolerationsToAdd).Iter() {
-			if toleration, ok := v.(string); ok {
-				pod.Spec.Tolerations = append(pod.Spec.Tolerations, getTolerationObject(toleration))
-			}
+		for _, toleration := range tolerationsToAdd {
+			patch = append(patch, PatchOps{
+				Op:    "add",
+				Path:  tolerationsPath + "/-",
+				Value: toleration,
+			})
 		}
-
-		patch = append(patch, PatchOps{
-			Op:    "replace",
-			Path:  "/spec/tolerations",
-			Value: pod.Spec.Tolerations,
-		})
 	}
 
 	return json.Marshal(patch)
 }
 
-func getTolerationObject(key string) corev1.Toleration {
-	var toleration corev1.Toleration
-
-	toleration.Key = key
-	toleration.Operator = corev1.TolerationOpExists
-	toleration.Effect = corev1.TaintEffectNoExecute
+// getTolerationObject returns the tolerations of the rule matching the given
+// resource.
+func getTolerationObject(resourceName string) []corev1.Toleration {
+	resource, ok := GetTargetResource(resourceName)
+	if !ok {
+		return nil
+	}
 
-	return toleration
+	return resource.TolerationsFor(resourceName)
 }
 
 func getTolerationObjects(tolerationsToAdd *mapset.Set) []corev1.Toleration {
 	var tolerations []corev1.Toleration
+	var resourceNames []string
 
 	for v := range (*tolerationsToAdd).Iter() {
-		if toleration, ok := v.(string); ok {
-			tolerations = append(tolerations, getTolerationObject(toleration))
+		if resourceName, ok := v.(string); ok {
+			resourceNames = append(resourceNames, resourceName)
+		}
+	}
+
+	// Keep the patch stable across invocations regardless of set ordering.
+	sort.Strings(resourceNames)
+
+	for _, resourceName := range resourceNames {
+		for _, toleration := range getTolerationObject(resourceName) {
+			// Resources sharing a taint key share the toleration.
+			if !hasToleration(tolerations, toleration) {
+				tolerations = append(tolerations, toleration)
+			}
 		}
 	}
 
 	return tolerations
 }
+
+// getMatchedRulesAnnotation lists the rule matched by each resource used by the
+// pod, as "resource=rule" pairs sorted by resource name.
+func getMatchedRulesAnnotation(pod *corev1.Pod) string {
+	var matches []string
+
+	for resourceName, resource := range GetMatchedRules(pod) {
+		matches = append(matches, resourceName+"="+resource.Rule())
+	}
+	sort.Strings(matches)
+
+	return strings.Join(matches, ",")
+}
@@ -8,10 +8,12 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
 
 	mapset "github.com/deckarep/golang-set"
+	jsonpatch "github.com/evanphx/json-patch"
 	admissionv1 "k8s.io/api/admission/v1"
 	core "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -60,6 +62,26 @@ func TestGetTaintsToAdd(t *testing.T) {
 		},
 	}
 
+	containerLimitingExtendedResource1 := core.Container{
+		Name: "test-extended-resource-type1-limits-only-container",
+		Resources: core.ResourceRequirements{
+			Limits: core.ResourceList{
+				core.ResourceName(targetExtendedResource1): *resource.NewQuantity(1, resource.DecimalSI),
+			},
+		},
+	}
+	containerRequestingZeroExtendedResource2 := core.Container{
+		Name: "test-extended-resource-type2-zero-request-container",
+		Resources: core.ResourceRequirements{
+			Requests: core.ResourceList{
+				core.ResourceName(targetExtendedResource2): *resource.NewQuantity(0, resource.DecimalSI),
+			},
+			Limits: core.ResourceList{
+				core.ResourceName(targetExtendedResource2): *resource.NewQuantity(1, resource.DecimalSI),
+			},
+		},
+	}
+
 	var targetResources ArrayFlags
 	targetResources.Set(targetExtendedResource1)
 	targetResources.Set(targetExtendedResource2)
@@ -109,7 +131,7 @@ func TestGetTaintsToAdd(t *testing.T) {
 					},
 				},
 			},
-			expectedTolerationsToAdd: mapset.NewSet(targetExtendedResource1),
+			expectedTolerationsToAdd: newDefaultTolerationSet(targetExtendedResource1),
 		},
 		{
 			description: "pod with init container with extended resource, expect toleration to be added",
@@ -120,7 +142,29 @@ func TestGetTaintsToAdd(t *testing.T) {
 					},
 				},
 			},
-			expectedTolerationsToAdd: mapset.NewSet(targetExtendedResource2),
+			expectedTolerationsToAdd: newDefaultTolerationSet(targetExtendedResource2),
+		},
+		{
+			description: "pod with container declaring extended resource only in limits, expect toleration to be added",
+			requestedPod: core.Pod{
+				Spec: core.PodSpec{
+					Containers: []core.Container{
+						containerLimitingExtendedResource1,
+					},
+				},
+			},
+			expectedTolerationsToAdd: newDefaultTolerationSet(targetExtendedResource1),
+		},
+		{
+			description: "pod with container requesting zero of extended resource but limiting it, expect request to win and no toleration to be added",
+			requestedPod: core.Pod{
+				Spec: core.PodSpec{
+					Containers: []core.Container{
+						containerRequestingZeroExtendedResource2,
+					},
+				},
+			},
+			expectedTolerationsToAdd: mapset.NewSet(),
 		},
 		{
 			description: "pod with existing tolerations and container with extended resource, expect existing tolerations to be preserved and new toleration to be added",
@@ -140,7 +184,7 @@ func TestGetTaintsToAdd(t *testing.T) {
 					},
 				},
 			},
-			expectedTolerationsToAdd: mapset.NewSet(targetExtendedResource1),
+			expectedTolerationsToAdd: newDefaultTolerationSet(targetExtendedResource1),
 		},
 		{
 			description: "pod with multiple extended resources, expect multiple tolerations to be added",
@@ -156,10 +200,10 @@ func TestGetTaintsToAdd(t *testing.T) {
 					},
 				},
 			},
-			expectedTolerationsToAdd: mapset.NewSet(targetExtendedResource1, targetExtendedResource2),
+			expectedTolerationsToAdd: newDefaultTolerationSet(targetExtendedResource1, targetExtendedResource2),
 		},
 		{
-			description: "pod with container requesting extended resource and existing correct toleration, expect no change in tolerations",
+			description: "pod with container requesting extended resource and existing toleration for one of the effects, expect only the missing effect to be added",
 			requestedPod: core.Pod{
 				Spec: core.PodSpec{
 					Containers: []core.Container{
@@ -176,10 +220,14 @@ func TestGetTaintsToAdd(t *testing.T) {
 					},
 				},
 			},
-			expectedTolerationsToAdd: mapset.NewSet(),
+			expectedTolerationsToAdd: mapset.NewSet(core.Toleration{
+				Key:      targetExtendedResource1,
+				Operator: core.TolerationOpExists,
+				Effect:   core.TaintEffectNoExecute,
+			}),
 		},
 		{
-			description: "pod with container requesting extended resource and existing toleration with the same key but different effect and value, expect existing tolerations to be preserved and do nothing yet....",
+			description: "pod with container requesting extended resource and existing toleration with the same key but different operator and value, expect existing tolerations to be preserved and new tolerations to be added",
 			requestedPod: core.Pod{
 				Spec: core.PodSpec{
 					Containers: []core.Container{
@@ -197,6 +245,18 @@ func TestGetTaintsToAdd(t *testing.T) {
 					},
 				},
 			},
+			expectedTolerationsToAdd: newDefaultTolerationSet(targetExtendedResource1),
+		},
+		{
+			description: "pod with container requesting extended resource and existing correct tolerations, expect no change in tolerations",
+			requestedPod: core.Pod{
+				Spec: core.PodSpec{
+					Containers: []core.Container{
+						containerRequestingExtendedResource1,
+					},
+					Tolerations: getTolerationObject(targetExtendedResource1),
+				},
+			},
 			expectedTolerationsToAdd: mapset.NewSet(),
 		},
 		{
@@ -215,19 +275,19 @@ func TestGetTaintsToAdd(t *testing.T) {
 					},
 				},
 			},
-			expectedTolerationsToAdd: mapset.NewSet(targetExtendedResource1),
+			expectedTolerationsToAdd: newDefaultTolerationSet(targetExtendedResource1),
 		},
 	}
 
 	for _, test := range tests {
 		tolerationsToAdd := GetExtendResourceTolerationsToAdd(&test.requestedPod)
 
-		if test.expectedTolerationsToAdd.Equal(*tolerationsToAdd) {
+		if test.expectedTolerationsToAdd.Equal(newTolerationSet(tolerationsToAdd)) {
 			// t.Logf("Test (%s) Succeed", test.description)
 		} else {
 			println("original pod toleration list: ", test.requestedPod.Spec.Tolerations)
 			println("expected: ", test.expectedTolerationsToAdd.String())
-			println("return of function: ", (*tolerationsToAdd).String())
+			println("return of function: ", newTolerationSet(tolerationsToAdd).String())
 			println()
 			t.Errorf("Test (%s) Failed", test.description)
 		}
@@ -417,6 +477,349 @@ func TestHttpRequest(t *testing.T) {
 	}
 }
 
+func TestMutateReachesFixedPoint(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+	amd := "amd.com/gpu"
+
+	var targetResources ArrayFlags
+	targetResources.Set(nvidia)
+	targetResources.Set(amd + ":NoSchedule")
+	SetTargetResourcesSet(targetResources)
+
+	gpuContainer := core.Container{
+		Name: "test-gpu-container",
+		Resources: core.ResourceRequirements{
+			Limits: core.ResourceList{
+				core.ResourceName(nvidia): *resource.NewQuantity(1, resource.DecimalSI),
+				core.ResourceName(amd):    *resource.NewQuantity(1, resource.DecimalSI),
+			},
+		},
+	}
+
+	tests := []struct {
+		description   string
+		requestedPod  core.Pod
+		expectedPatch bool
+	}{
+		{
+			description:  "pod without extended resources, expect no patch",
+			requestedPod: core.Pod{Spec: core.PodSpec{Containers: []core.Container{{Name: "test-cpu-container"}}}},
+		},
+		{
+			description:   "gpu pod without tolerations",
+			requestedPod:  core.Pod{Spec: core.PodSpec{Containers: []core.Container{gpuContainer}}},
+			expectedPatch: true,
+		},
+		{
+			description: "gpu pod with unrelated tolerations",
+			requestedPod: core.Pod{Spec: core.PodSpec{
+				Containers: []core.Container{gpuContainer},
+				Tolerations: []core.Toleration{
+					{Key: "foo", Operator: core.TolerationOpEqual, Value: "bar", Effect: core.TaintEffectNoSchedule},
+				},
+			}},
+			expectedPatch: true,
+		},
+		{
+			description: "gpu pod with part of the tolerations",
+			requestedPod: core.Pod{Spec: core.PodSpec{
+				Containers: []core.Container{gpuContainer},
+				Tolerations: []core.Toleration{
+					{Key: nvidia, Operator: core.TolerationOpExists, Effect: core.TaintEffectNoExecute},
+				},
+			}},
+			expectedPatch: true,
+		},
+		{
+			description: "gpu pod with every toleration, expect no patch",
+			requestedPod: core.Pod{Spec: core.PodSpec{
+				Containers:  []core.Container{gpuContainer},
+				Tolerations: append(getTolerationObject(amd), getTolerationObject(nvidia)...),
+			}},
+		},
+	}
+
+	for _, test := range tests {
+		first := mutate(newPodAdmissionReview(t, test.requestedPod))
+		if !first.Allowed {
+			t.Errorf("Test (%s) Failed: first mutation not allowed", test.description)
+			continue
+		}
+
+		if (first.Patch != nil) != test.expectedPatch {
+			t.Errorf("Test (%s) Failed: expected patch %v, got %s", test.description, test.expectedPatch, string(first.Patch))
+			continue
+		}
+
+		mutatedPod := applyPatch(t, test.requestedPod, first.Patch)
+		if missing := GetExtendResourceTolerationsToAdd(&mutatedPod); len(missing) != 0 {
+			t.Errorf("Test (%s) Failed: tolerations still missing after patch: %v", test.description, missing)
+		}
+
+		second := mutate(newPodAdmissionReview(t, mutatedPod))
+		if !second.Allowed || second.Patch != nil {
+			t.Errorf("Test (%s) Failed: expected no patch on reinvocation, got %s", test.description, string(second.Patch))
+			continue
+		}
+
+		if !reflect.DeepEqual(applyPatch(t, mutatedPod, second.Patch), mutatedPod) {
+			t.Errorf("Test (%s) Failed: mutated pod is not a fixed point", test.description)
+		}
+	}
+}
+
+func TestGetTolerationsPatchData(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+
+	var targetResources ArrayFlags
+	targetResources.Set(nvidia)
+	SetTargetResourcesSet(targetResources)
+
+	gpuContainer := core.Container{
+		Name: "test-gpu-container",
+		Resources: core.ResourceRequirements{
+			Requests: core.ResourceList{
+				core.ResourceName(nvidia): *resource.NewQuantity(1, resource.DecimalSI),
+			},
+		},
+	}
+	otherToleration := core.Toleration{Key: "foo", Operator: core.TolerationOpEqual, Value: "bar", Effect: core.TaintEffectNoSchedule}
+
+	tests := []struct {
+		description         string
+		requestedPod        core.Pod
+		expectedPatch       []PatchOps
+		expectedTolerations []core.Toleration
+	}{
+		{
+			description:  "pod without tolerations, expect the tolerations array to be added",
+			requestedPod: core.Pod{Spec: core.PodSpec{Containers: []core.Container{gpuContainer}}},
+			expectedPatch: []PatchOps{
+				{Op: "add", Path: "/spec/tolerations", Value: getTolerationObject(nvidia)},
+			},
+			expectedTolerations: getTolerationObject(nvidia),
+		},
+		{
+			description: "pod with other tolerations, expect each toleration to be appended",
+			requestedPod: core.Pod{Spec: core.PodSpec{
+				Containers:  []core.Container{gpuContainer},
+				Tolerations: []core.Toleration{otherToleration},
+			}},
+			expectedPatch: []PatchOps{
+				{Op: "add", Path: "/spec/tolerations/-", Value: getTolerationObject(nvidia)[0]},
+				{Op: "add", Path: "/spec/tolerations/-", Value: getTolerationObject(nvidia)[1]},
+			},
+			expectedTolerations: append([]core.Toleration{otherToleration}, getTolerationObject(nvidia)...),
+		},
+		{
+			description: "pod with one of the tolerations, expect only the missing one to be appended",
+			requestedPod: core.Pod{Spec: core.PodSpec{
+				Containers:  []core.Container{gpuContainer},
+				Tolerations: []core.Toleration{otherToleration, getTolerationObject(nvidia)[1]},
+			}},
+			expectedPatch: []PatchOps{
+				{Op: "add", Path: "/spec/tolerations/-", Value: getTolerationObject(nvidia)[0]},
+			},
+			expectedTolerations: []core.Toleration{otherToleration, getTolerationObject(nvidia)[1], getTolerationObject(nvidia)[0]},
+		},
+	}
+
+	for _, test := range tests {
+		patchData, err := getTolerationsPatchData(test.requestedPod, GetExtendResourceTolerationsToAdd(&test.requestedPod))
+		if err != nil {
+			t.Errorf("Test (%s) Failed: %v", test.description, err)
+			continue
+		}
+
+		expectedPatchData, _ := json.Marshal(test.expectedPatch)
+		if string(patchData) != string(expectedPatchData) {
+			t.Errorf("Test (%s) Failed: expected patch %s, got %s", test.description, string(expectedPatchData), string(patchData))
+		}
+
+		patchedPod := applyPatch(t, test.requestedPod, patchData)
+		if !reflect.DeepEqual(patchedPod.Spec.Tolerations, test.expectedTolerations) {
+			t.Errorf("Test (%s) Failed: expected tolerations %v, got %v", test.description, test.expectedTolerations, patchedPod.Spec.Tolerations)
+		}
+	}
+}
+
+func TestParseTargetResource(t *testing.T) {
+	tests := []struct {
+		description    string
+		value          string
+		expected       TargetResource
+		expectingError bool
+	}{
+		{
+			description: "resource name only, expect default effects",
+			value:       "nvidia.com/gpu",
+			expected:    TargetResource{Name: "nvidia.com/gpu", Tolerations: newExistsTolerations("nvidia.com/gpu", DefaultTolerationEffects...)},
+		},
+		{
+			description: "resource name with single effect",
+			value:       "nvidia.com/gpu:NoSchedule",
+			expected:    TargetResource{Name: "nvidia.com/gpu", Tolerations: newExistsTolerations("nvidia.com/gpu", core.TaintEffectNoSchedule)},
+		},
+		{
+			description: "resource name with every effect",
+			value:       "amd.com/gpu:NoSchedule,PreferNoSchedule,NoExecute",
+			expected: TargetResource{Name: "amd.com/gpu", Tolerations: newExistsTolerations("amd.com/gpu",
+				core.TaintEffectNoSchedule, core.TaintEffectPreferNoSchedule, core.TaintEffectNoExecute,
+			)},
+		},
+		{
+			description: "resource name with All, expect empty effect",
+			value:       "amd.com/gpu:All",
+			expected:    TargetResource{Name: "amd.com/gpu", Tolerations: newExistsTolerations("amd.com/gpu", "")},
+		},
+		{
+			description:    "unknown effect, expect error",
+			value:          "nvidia.com/gpu:NoRun",
+			expectingError: true,
+		},
+		{
+			description:    "duplicated effect, expect error",
+			value:          "nvidia.com/gpu:NoSchedule,NoSchedule",
+			expectingError: true,
+		},
+		{
+			description:    "empty effect list, expect error",
+			value:          "nvidia.com/gpu:",
+			expectingError: true,
+		},
+		{
+			description:    "empty resource name, expect error",
+			value:          ":NoSchedule",
+			expectingError: true,
+		},
+	}
+
+	for _, test := range tests {
+		targetResource, err := ParseTargetResource(test.value)
+
+		if test.expectingError {
+			if err == nil {
+				t.Errorf("Test (%s) Failed: expected error, got %v", test.description, targetResource)
+			}
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(targetResource, test.expected) {
+			t.Errorf("Test (%s) Failed: expected %v, got %v (err: %v)", test.description, test.expected, targetResource, err)
+		}
+	}
+}
+
+func TestGetTolerationObjects(t *testing.T) {
+	var targetResources ArrayFlags
+	targetResources.Set("nvidia.com/gpu")
+	targetResources.Set("amd.com/gpu:NoSchedule")
+	targetResources.Set("xilinx.com/fpga:All")
+
+	if err := SetTargetResourcesSet(targetResources); err != nil {
+		t.Fatalf("SetTargetResourcesSet failed: %s", err)
+	}
+
+	resourcesUsed := mapset.NewSet("nvidia.com/gpu", "amd.com/gpu", "xilinx.com/fpga")
+	tolerations := getTolerationObjects(&resourcesUsed)
+	expected := []core.Toleration{
+		{Key: "amd.com/gpu", Operator: core.TolerationOpExists, Effect: core.TaintEffectNoSchedule},
+		{Key: "nvidia.com/gpu", Operator: core.TolerationOpExists, Effect: core.TaintEffectNoSchedule},
+		{Key: "nvidia.com/gpu", Operator: core.TolerationOpExists, Effect: core.TaintEffectNoExecute},
+		{Key: "xilinx.com/fpga", Operator: core.TolerationOpExists},
+	}
+
+	if !reflect.DeepEqual(tolerations, expected) {
+		t.Errorf("expected tolerations %v, got %v", expected, tolerations)
+	}
+}
+
+func newTolerationSet(tolerations []core.Toleration) mapset.Set {
+	tolerationSet := mapset.NewSet()
+
+	for _, toleration := range tolerations {
+		tolerationSet.Add(toleration)
+	}
+
+	return tolerationSet
+}
+
+func newExistsTolerations(key string, effects ...core.TaintEffect) []core.Toleration {
+	var tolerations []core.Toleration
+
+	for _, effect := range effects {
+		tolerations = append(tolerations, core.Toleration{
+			Key:      key,
+			Operator: core.TolerationOpExists,
+			Effect:   effect,
+		})
+	}
+
+	return tolerations
+}
+
+func newDefaultTolerationSet(resourceNames ...string) mapset.Set {
+	tolerationSet := mapset.NewSet()
+
+	for _, resourceName := range resourceNames {
+		for _, effect := range DefaultTolerationEffects {
+			tolerationSet.Add(core.Toleration{
+				Key:      resourceName,
+				Operator: core.TolerationOpExists,
+				Effect:   effect,
+			})
+		}
+	}
+
+	return tolerationSet
+}
+
+func newPodAdmissionReview(t *testing.T, pod core.Pod) *admissionv1.AdmissionReview {
+	podData, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatalf("marshaling pod: %v", err)
+	}
+
+	return &admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "31390b02-650e-11eb-ae93-0242ac130002",
+			Kind:      v1.GroupVersionKind{Kind: "Pod"},
+			Operation: "CREATE",
+			Object:    runtime.RawExtension{Raw: podData},
+		},
+	}
+}
+
+// applyPatch applies a JSON patch returned by the mutating webhook to the pod,
+// the way the apiserver does. An empty patch returns the pod unchanged.
+func applyPatch(t *testing.T, pod core.Pod, patchData []byte) core.Pod {
+	if len(patchData) == 0 {
+		return pod
+	}
+
+	podData, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatalf("marshaling pod: %v", err)
+	}
+
+	patch, err := jsonpatch.DecodePatch(patchData)
+	if err != nil {
+		t.Fatalf("decoding patch %s: %v", string(patchData), err)
+	}
+
+	patchedData, err := patch.Apply(podData)
+	if err != nil {
+		t.Fatalf("applying patch %s: %v", string(patchData), err)
+	}
+
+	var patchedPod core.Pod
+	if err := json.Unmarshal(patchedData, &patchedPod); err != nil {
+		t.Fatalf("unmarshaling patched pod: %v", err)
+	}
+
+	return patchedPod
+}
+
 func GetAdmissionWebhookServerNoTls(port int) *http.Server {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/mutate", HandleMutate)
@@ -457,7 +860,14 @@ func isValidPatchData(patchData *[]PatchOps, expectedPatches *mapset.Set) bool {
 			continue
 		}
 
-		var tolerations []interface{} = (patch.Value).([]interface{})
+		var tolerations []interface{}
+
+		switch value := patch.Value.(type) {
+		case []interface{}:
+			tolerations = value
+		case map[string]interface{}:
+			tolerations = []interface{}{value}
+		}
 
 		for _, toleration := range tolerations {
 			tolerationMap := toleration.(map[string]interface{})
@@ -483,3 +893,42 @@ func isValidPatchData(patchData *[]PatchOps, expectedPatches *mapset.Set) bool {
 
 //     publicKey := &privateKey.PublicKey
 // }
+
+func TestMutateUpdate(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+	SetTargetResourcesSet(ArrayFlags{nvidia})
+
+	SetMutatePodTemplates(true)
+	defer SetMutatePodTemplates(false)
+
+	gpuPod := newPodRequesting(nvidia)
+
+	tests := []struct {
+		description   string
+		group         string
+		resource      string
+		operation     admissionv1.Operation
+		expectedPatch bool
+	}{
+		{"pod created without tolerations, expect patch", "", "pods", admissionv1.Create, true},
+		{"pod updated without tolerations, expect no patch of the running pod", "", "pods", admissionv1.Update, false},
+		{"deployment created without tolerations, expect patch", "apps", "deployments", admissionv1.Create, true},
+		{"deployment updated without tolerations, expect patch of its template", "apps", "deployments", admissionv1.Update, true},
+		{"job created without tolerations, expect patch", "batch", "jobs", admissionv1.Create, true},
+		{"job updated without tolerations, expect no patch of its immutable template", "batch", "jobs", admissionv1.Update, false},
+		{"cronjob updated without tolerations, expect patch of its job template", "batch", "cronjobs", admissionv1.Update, true},
+	}
+
+	for _, test := range tests {
+		req := newWorkloadRequest(t, test.group, "v1", test.resource, gpuPod)
+		req.Operation = test.operation
+		if test.operation == admissionv1.Update {
+			req.OldObject = req.Object
+		}
+
+		response := mutate(&admissionv1.AdmissionReview{Request: req})
+		if !response.Allowed || (response.Patch != nil) != test.expectedPatch {
+			t.Errorf("Test (%s) Failed: expected patch %v, got %v", test.description, test.expectedPatch, response)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package webhook
+
+import (
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog"
+)
+
+// NamespacePolicy selects the namespaces whose pods the webhooks apply the
+// rules to. The pods of other namespaces are neither mutated nor validated.
+type NamespacePolicy struct {
+	// Include lists the namespaces the rules apply to, all if empty.
+	Include []string `json:"include,omitempty"`
+	// Exclude lists namespaces exempt from the rules.
+	Exclude []string `json:"exclude,omitempty"`
+	// Selector selects the namespaces the rules apply to by label, all if
+	// unset.
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+	// ExcludeSelector selects namespaces exempt from the rules by label.
+	ExcludeSelector *metav1.LabelSelector `json:"excludeSelector,omitempty"`
+	// Labels are the labels of namespaces used by the selectors, unless the
+	// labels are looked up in the cluster.
+	Labels map[string]map[string]string `json:"labels,omitempty"`
+}
+
+// namespaceSelector is a validated NamespacePolicy.
+type namespaceSelector struct {
+	policy          *NamespacePolicy
+	selector        labels.Selector
+	excludeSelector labels.Selector
+}
+
+// namespaceLister looks up the labels of namespaces in the cluster, see
+// SetNamespaceLister.
+var namespaceLister corelisters.NamespaceLister
+
+// SetNamespaceLister sets the lister, usually backed by an informer cache,
+// the namespace labels are looked up with in place of the static labels of the
+// configuration.
+func SetNamespaceLister(lister corelisters.NamespaceLister) {
+	namespaceLister = lister
+}
+
+// defaultNamespacePolicy is the policy of configurations which set none. It
+// excludes the namespace of the webhook, where system add-ons such as device
+// plugins run.
+func defaultNamespacePolicy() *NamespacePolicy {
+	return &NamespacePolicy{Exclude: []string{controllerNameSpaceName}}
+}
+
+func validateNamespacePolicy(policy *NamespacePolicy, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if policy == nil {
+		return allErrs
+	}
+
+	validateNames := func(names []string, path *field.Path) {
+		for i, name := range names {
+			for _, msg := range validation.IsDNS1123Label(name) {
+				allErrs = append(allErrs, field.Invalid(path.Index(i), name, msg))
+			}
+		}
+	}
+	validateNames(policy.Include, path.Child("include"))
+	validateNames(policy.Exclude, path.Child("exclude"))
+
+	if _, err := metav1.LabelSelectorAsSelector(policy.Selector); err != nil {
+		allErrs = append(allErrs, field.Invalid(path.Child("selector"), policy.Selector, err.Error()))
+	}
+	if _, err := metav1.LabelSelectorAsSelector(policy.ExcludeSelector); err != nil {
+		allErrs = append(allErrs, field.Invalid(path.Child("excludeSelector"), policy.ExcludeSelector, err.Error()))
+	}
+
+	for namespace, namespaceLabels := range policy.Labels {
+		labelsPath := path.Child("labels").Key(namespace)
+		for _, msg := range validation.IsDNS1123Label(namespace) {
+			allErrs = append(allErrs, field.Invalid(labelsPath, namespace, msg))
+		}
+		for key, value := range namespaceLabels {
+			for _, msg := range validation.IsQualifiedName(key) {
+				allErrs = append(allErrs, field.Invalid(labelsPath.Key(key), key, msg))
+			}
+			for _, msg := range validation.IsValidLabelValue(value) {
+				allErrs = append(allErrs, field.Invalid(labelsPath.Key(key), value, msg))
+			}
+		}
+	}
+
+	return allErrs
+}
+
+// newNamespaceSelector compiles a policy, which must be validated.
+func newNamespaceSelector(policy *NamespacePolicy) *namespaceSelector {
+	if policy == nil {
+		return &namespaceSelector{selector: labels.Everything(), excludeSelector: labels.Nothing()}
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(policy.Selector)
+	if err != nil {
+		panic(err)
+	}
+
+	// An unset selector selects nothing here, rather than everything.
+	excludeSelector := labels.Nothing()
+	if policy.ExcludeSelector != nil {
+		excludeSelector, err = metav1.LabelSelectorAsSelector(policy.ExcludeSelector)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return &namespaceSelector{policy: policy, selector: selector, excludeSelector: excludeSelector}
+}
+
+// exemptionReason returns why the rules do not apply to the namespace, or an
+// empty string if they do. Requests without a namespace are never exempt.
+func (s *namespaceSelector) exemptionReason(namespace string) string {
+	if namespace == "" {
+		return ""
+	}
+	if s.policy == nil {
+		return ""
+	}
+
+	if containsString(s.policy.Exclude, namespace) {
+		return "namespace " + namespace + " is excluded"
+	}
+	if len(s.policy.Include) != 0 && !containsString(s.policy.Include, namespace) {
+		return "namespace " + namespace + " is not included"
+	}
+
+	if s.policy.Selector == nil && s.policy.ExcludeSelector == nil {
+		return ""
+	}
+
+	namespaceLabels := labels.Set(s.getLabels(namespace))
+	if s.excludeSelector.Matches(namespaceLabels) {
+		return "namespace " + namespace + " is excluded by label"
+	}
+	if !s.selector.Matches(namespaceLabels) {
+		return "namespace " + namespace + " is not selected by label"
+	}
+
+	return ""
+}
+
+// getLabels returns the labels of the namespace, looked up in the cluster if
+// a lister is set and in the configuration otherwise.
+func (s *namespaceSelector) getLabels(namespace string) map[string]string {
+	if namespaceLister == nil {
+		return s.policy.Labels[namespace]
+	}
+
+	ns, err := namespaceLister.Get(namespace)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			klog.Errorf("Could not look up namespace %s: %v", namespace, err)
+		}
+		return nil
+	}
+
+	return ns.Labels
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,112 @@
+package webhook
+
+import (
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestNamespacePolicy(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+
+	config := NewConfig()
+	config.AddTargetResourceFlags(ArrayFlags{nvidia})
+	config.Namespaces = &NamespacePolicy{
+		Exclude:         []string{"gpu-operator"},
+		Selector:        &metav1.LabelSelector{MatchLabels: map[string]string{"gpu-policy": "enabled"}},
+		ExcludeSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "monitoring", Operator: metav1.LabelSelectorOpExists}}},
+		Labels: map[string]map[string]string{
+			"team-a":       {"gpu-policy": "enabled"},
+			"team-b":       {"gpu-policy": "disabled"},
+			"gpu-operator": {"gpu-policy": "enabled"},
+			"monitoring":   {"gpu-policy": "enabled", "monitoring": "true"},
+		},
+	}
+	ruleSet, err := config.NewRuleSet()
+	if err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	SetActiveRuleSet(ruleSet)
+
+	pod := newPodRequesting("", corev1.Toleration{Key: nvidia, Operator: corev1.TolerationOpExists})
+
+	cases := []struct {
+		namespace string
+		exempt    bool
+	}{
+		{"team-a", false},
+		{"team-b", true},
+		{"team-c", true},
+		{"gpu-operator", true},
+		{"monitoring", true},
+		{controllerNameSpaceName, true},
+	}
+
+	for _, c := range cases {
+		t.Logf("\tTest: A pod with no extended resources which tolerates Nvidia GPU in namespace %s", c.namespace)
+		req := &admissionv1.AdmissionRequest{Namespace: c.namespace, Resource: podResource, Object: runtime.RawExtension{Raw: marshal(pod)}}
+		result, err := validateExtendResources(req)
+
+		reason := result.auditAnnotations[exemptionAnnotationKey]
+		if (err == nil) != c.exempt || (reason != "") != c.exempt {
+			t.Errorf("\t%s\tunexpected result: got %v with exemption %q, want exempt %v", failed, err, reason, c.exempt)
+		} else {
+			t.Logf("\t%s\treturned: %v %q.", succeed, err, reason)
+		}
+	}
+
+	gpuPod := newPodRequesting(nvidia)
+	for _, c := range cases {
+		req := &admissionv1.AdmissionRequest{Namespace: c.namespace, Kind: metav1.GroupVersionKind{Kind: "Pod"}, Object: runtime.RawExtension{Raw: marshal(gpuPod)}}
+		if response := mutate(&admissionv1.AdmissionReview{Request: req}); (response.Patch == nil) != c.exempt {
+			t.Errorf("\t%s\texpected a patch in namespace %s unless exempt %v, got %s", failed, c.namespace, c.exempt, response.Patch)
+		}
+	}
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b", Labels: map[string]string{"gpu-policy": "enabled"}}})
+	SetNamespaceLister(corelisters.NewNamespaceLister(indexer))
+	defer SetNamespaceLister(nil)
+
+	if reason := ruleSet.exemptionReason("team-b"); reason != "" {
+		t.Errorf("\t%s\texpected the labels of the cluster to select team-b, got %q", failed, reason)
+	}
+	if reason := ruleSet.exemptionReason("team-a"); reason == "" {
+		t.Errorf("\t%s\texpected team-a unknown to the cluster not to be selected", failed)
+	}
+}
+
+func TestDefaultNamespacePolicy(t *testing.T) {
+	cases := []struct {
+		description string
+		config      string
+		exempt      bool
+	}{
+		{"config without namespaces, expect kube-system to be excluded", gpuConfig, true},
+		{"config with an empty namespace policy, expect kube-system to be checked", gpuConfig + "namespaces: {}\n", false},
+		{"config excluding other namespaces, expect kube-system to be checked", gpuConfig + "namespaces:\n  exclude: [gpu-operator]\n", false},
+	}
+
+	for _, c := range cases {
+		t.Logf("\tTest: %s", c.description)
+		config, err := ParseConfig([]byte(c.config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ruleSet, err := config.NewRuleSet()
+		if err != nil {
+			t.Fatalf("invalid config: %v", err)
+		}
+
+		if reason := ruleSet.exemptionReason(controllerNameSpaceName); (reason != "") != c.exempt {
+			t.Errorf("\t%s\texpected exempt %v, got %q", failed, c.exempt, reason)
+		} else {
+			t.Logf("\t%s\treturned: %q.", succeed, reason)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+)
+
+const (
+	// nodeTaintedReason is the reason of the events of taints added to a node.
+	nodeTaintedReason = "ExtendedResourceTainted"
+	// nodeUntaintedReason is the reason of the events of stale taints removed
+	// from a node.
+	nodeUntaintedReason = "ExtendedResourceUntainted"
+
+	// managedTaintsAnnotation records the taints added to a node by the node
+	// tainter, as comma-separated key:effect pairs. Only these are removed
+	// when the node no longer advertises their resource, so taints set by
+	// other means, e.g. --register-with-taints before the device plugin
+	// reports the resource, are kept.
+	managedTaintsAnnotation = "gpu-resource-toleration-admission-controller/managed-taints"
+)
+
+// NodeTaint is a taint added to a node for an extended resource it advertises.
+type NodeTaint struct {
+	corev1.Taint
+	// Resource is the advertised resource the taint is added for.
+	Resource string
+}
+
+// NodeTaintChange reports the taints added to and removed from a node.
+type NodeTaintChange struct {
+	Node    string
+	Added   []NodeTaint
+	Removed []corev1.Taint
+}
+
+// IsEmpty reports whether the node was left unchanged.
+func (c NodeTaintChange) IsEmpty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0
+}
+
+// NodeTainter keeps the nodes advertising a target resource tainted with the
+// taints of its rule, so that only pods tolerating them, which the webhooks
+// restrict to pods using the resource, are scheduled there. Taints it added
+// for target resources a node no longer advertises are removed. Other taints
+// are never removed.
+type NodeTainter struct {
+	client   kubernetes.Interface
+	recorder record.EventRecorder
+	queue    workqueue.RateLimitingInterface
+	synced   cache.InformerSynced
+}
+
+// NewNodeTainter returns a NodeTainter syncing the nodes of the informer. Each
+// change is logged and, unless the recorder is nil, recorded as an event of
+// the node.
+func NewNodeTainter(client kubernetes.Interface, nodeInformer coreinformers.NodeInformer, recorder record.EventRecorder) *NodeTainter {
+	tainter := &NodeTainter{
+		client:   client,
+		recorder: recorder,
+		queue:    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "nodes"),
+		synced:   nodeInformer.Informer().HasSynced,
+	}
+
+	// Resyncs of the informer requeue every node, which applies changes of
+	// the rules to nodes which did not change themselves.
+	nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: tainter.enqueue,
+		UpdateFunc: func(_, newObj interface{}) {
+			tainter.enqueue(newObj)
+		},
+	})
+
+	return tainter
+}
+
+func (t *NodeTainter) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	t.queue.Add(key)
+}
+
+// Run syncs the nodes with the given number of workers until the stop channel
+// is closed.
+func (t *NodeTainter) Run(workers int, stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer t.queue.ShutDown()
+
+	klog.Info("Starting node tainter")
+	if !cache.WaitForCacheSync(stopCh, t.synced) {
+		klog.Error("Failed to sync node cache")
+		return
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.Until(t.runWorker, time.Second, stopCh)
+	}
+
+	<-stopCh
+	klog.Info("Stopping node tainter")
+}
+
+func (t *NodeTainter) runWorker() {
+	for t.processNextItem() {
+	}
+}
+
+func (t *NodeTainter) processNextItem() bool {
+	key, quit := t.queue.Get()
+	if quit {
+		return false
+	}
+	defer t.queue.Done(key)
+
+	if _, err := t.SyncNode(key.(string)); err != nil {
+		klog.Errorf("Could not sync taints of node %s: %v", key, err)
+		t.queue.AddRateLimited(key)
+		return true
+	}
+
+	t.queue.Forget(key)
+	return true
+}
+
+// SyncNode taints the node with the taints of the target resources it
+// advertises and removes the ones it added for resources the node no longer
+// advertises. A node which does not exist is left alone.
+func (t *NodeTainter) SyncNode(name string) (NodeTaintChange, error) {
+	var change NodeTaintChange
+	var node *corev1.Node
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var err error
+		node, err = t.client.CoreV1().Nodes().Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		var taints []corev1.Taint
+		var managed string
+		taints, managed, change = reconcileNodeTaints(GetActiveRuleSet(), node)
+		if change.IsEmpty() && managed == node.Annotations[managedTaintsAnnotation] {
+			return nil
+		}
+
+		node = node.DeepCopy()
+		node.Spec.Taints = taints
+		if managed == "" {
+			delete(node.Annotations, managedTaintsAnnotation)
+		} else {
+			if node.Annotations == nil {
+				node.Annotations = make(map[string]string)
+			}
+			node.Annotations[managedTaintsAnnotation] = managed
+		}
+		_, err = t.client.CoreV1().Nodes().Update(context.TODO(), node, metav1.UpdateOptions{})
+		return err
+	})
+	if apierrors.IsNotFound(err) {
+		return NodeTaintChange{Node: name}, nil
+	}
+	if err != nil {
+		return NodeTaintChange{Node: name}, err
+	}
+
+	t.report(node, change)
+	return change, nil
+}
+
+func (t *NodeTainter) report(node *corev1.Node, change NodeTaintChange) {
+	for _, taint := range change.Added {
+		message := fmt.Sprintf("Added taint %s for extended resource %s", taint.ToString(), taint.Resource)
+		klog.Infof("Node %s: %s", node.Name, message)
+		if t.recorder != nil {
+			t.recorder.Event(node, corev1.EventTypeNormal, nodeTaintedReason, message)
+		}
+	}
+
+	for _, taint := range change.Removed {
+		message := fmt.Sprintf("Removed taint %s, no extended resource advertised by the node is tainted with it", taint.ToString())
+		klog.Infof("Node %s: %s", node.Name, message)
+		if t.recorder != nil {
+			t.recorder.Event(node, corev1.EventTypeNormal, nodeUntaintedReason, message)
+		}
+	}
+}
+
+// reconcileNodeTaints returns the taints the node should carry according to
+// the rule set, the value of its managed taints annotation, and the change
+// from its current taints. Taints the node tainter added which no advertised
+// resource is tainted with are stale and removed, even if their key no longer
+// belongs to any rule. A taint of an advertised resource with another value is
+// replaced. Other taints are kept.
+func reconcileNodeTaints(ruleSet *RuleSet, node *corev1.Node) ([]corev1.Taint, string, NodeTaintChange) {
+	change := NodeTaintChange{Node: node.Name}
+	desired := desiredNodeTaints(ruleSet, node)
+	managed := strings.Split(node.Annotations[managedTaintsAnnotation], ",")
+
+	var taints []corev1.Taint
+	var stillManaged []string
+	for _, taint := range node.Spec.Taints {
+		isManaged := containsString(managed, managedTaintKey(taint))
+
+		var keep bool
+		switch {
+		case hasNodeTaint(taints, taint):
+			keep = !isManaged && !ruleSet.isTargetTaintKey(taint.Key)
+		case satisfiesNodeTaint(taint, desired):
+			keep = true
+		default:
+			keep = !isManaged && !isDesiredNodeTaint(taint, desired)
+		}
+		if !keep {
+			change.Removed = append(change.Removed, taint)
+			continue
+		}
+
+		taints = append(taints, taint)
+		if isManaged {
+			stillManaged = append(stillManaged, managedTaintKey(taint))
+		}
+	}
+
+	for _, taint := range desired {
+		if hasNodeTaint(taints, taint.Taint) {
+			continue
+		}
+
+		added := taint.Taint
+		if added.Effect == corev1.TaintEffectNoExecute {
+			now := metav1.Now()
+			added.TimeAdded = &now
+		}
+		taints = append(taints, added)
+		stillManaged = append(stillManaged, managedTaintKey(added))
+		change.Added = append(change.Added, NodeTaint{Taint: added, Resource: taint.resourceName})
+	}
+
+	sort.Strings(stillManaged)
+	return taints, strings.Join(stillManaged, ","), change
+}
+
+// managedTaintKey identifies a taint in the managed taints annotation.
+func managedTaintKey(taint corev1.Taint) string {
+	return taint.Key + ":" + string(taint.Effect)
+}
+
+// advertisedTaint is a taint of a target resource advertised by a node.
+type advertisedTaint struct {
+	guardedTaint
+	resourceName string
+}
+
+// desiredNodeTaints returns the taints of the target resources with a
+// non-zero capacity or allocatable quantity on the node, one per key and
+// effect.
+func desiredNodeTaints(ruleSet *RuleSet, node *corev1.Node) []advertisedTaint {
+	var resourceNames []string
+	for _, list := range []corev1.ResourceList{node.Status.Capacity, node.Status.Allocatable} {
+		for name, quantity := range list {
+			if !quantity.IsZero() && !containsString(resourceNames, string(name)) {
+				resourceNames = append(resourceNames, string(name))
+			}
+		}
+	}
+	sort.Strings(resourceNames)
+
+	var taints []advertisedTaint
+	for _, name := range resourceNames {
+		resource, ok := ruleSet.Match(name)
+		if !ok {
+			continue
+		}
+
+		for _, taint := range resource.taintsFor(name) {
+			duplicate := false
+			for _, existing := range taints {
+				if existing.Key == taint.Key && existing.Effect == taint.Effect {
+					duplicate = true
+					break
+				}
+			}
+			if !duplicate {
+				taints = append(taints, advertisedTaint{guardedTaint: taint, resourceName: name})
+			}
+		}
+	}
+
+	return taints
+}
+
+// satisfiesNodeTaint reports whether the taint is one of the desired taints,
+// with any value for a desired taint whose value is not known.
+func satisfiesNodeTaint(taint corev1.Taint, desired []advertisedTaint) bool {
+	for _, d := range desired {
+		if taint.Key == d.Key && taint.Effect == d.Effect && (d.anyValue || taint.Value == d.Value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isDesiredNodeTaint reports whether a taint of the same key and effect is
+// desired, whatever its value.
+func isDesiredNodeTaint(taint corev1.Taint, desired []advertisedTaint) bool {
+	for _, d := range desired {
+		if taint.Key == d.Key && taint.Effect == d.Effect {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasNodeTaint reports whether a taint of the same key and effect exists.
+func hasNodeTaint(taints []corev1.Taint, taint corev1.Taint) bool {
+	for _, existing := range taints {
+		if existing.Key == taint.Key && existing.Effect == taint.Effect {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,201 @@
+package webhook
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func newNode(name string, capacity corev1.ResourceList, taints ...corev1.Taint) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       corev1.NodeSpec{Taints: taints},
+		Status:     corev1.NodeStatus{Capacity: capacity, Allocatable: capacity},
+	}
+}
+
+// newManagedNode records the key:effect pairs as taints added by the node
+// tainter.
+func newManagedNode(node *corev1.Node, managed string) *corev1.Node {
+	node.Annotations = map[string]string{managedTaintsAnnotation: managed}
+	return node
+}
+
+func taintStrings(taints []corev1.Taint) []string {
+	var strs []string
+	for _, taint := range taints {
+		strs = append(strs, taint.ToString())
+	}
+	sort.Strings(strs)
+
+	return strs
+}
+
+func TestSyncNodeTaints(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+	amd := "amd.com/gpu"
+	mig := "nvidia.com/mig-1g.5gb"
+	intel := "gpu.intel.com/i915"
+
+	config := NewConfig()
+	config.AddTargetResourceFlags(ArrayFlags{nvidia, amd + ":NoSchedule"})
+	config.Groups = []ResourceGroup{
+		{Name: "nvidia-mig", Resources: []string{"nvidia.com/mig-*"}, Tolerations: []TolerationTemplate{{Key: "mig", Value: "mixed", Effect: "NoSchedule"}}},
+	}
+	resources, err := config.Validate()
+	if err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	SetTargetResources(resources)
+
+	gpus := func(name string, count int64) corev1.ResourceList {
+		return corev1.ResourceList{
+			corev1.ResourceCPU:        *resource.NewQuantity(8, resource.DecimalSI),
+			corev1.ResourceName(name): *resource.NewQuantity(count, resource.DecimalSI),
+		}
+	}
+	unrelated := corev1.Taint{Key: "dedicated", Value: "ml", Effect: corev1.TaintEffectNoSchedule}
+
+	tests := []struct {
+		description     string
+		node            *corev1.Node
+		expectedTaints  []string
+		expectedAdded   int
+		expectedRemoved int
+	}{
+		{
+			description:    "node advertising Nvidia GPU, expect its taints to be added",
+			node:           newNode("gpu", gpus(nvidia, 4), unrelated),
+			expectedTaints: []string{"dedicated=ml:NoSchedule", nvidia + ":NoExecute", nvidia + ":NoSchedule"},
+			expectedAdded:  2,
+		},
+		{
+			description:    "node already tainted with any value, expect no change",
+			node:           newNode("tainted", gpus(amd, 1), corev1.Taint{Key: amd, Value: "present", Effect: corev1.TaintEffectNoSchedule}),
+			expectedTaints: []string{amd + "=present:NoSchedule"},
+		},
+		{
+			description:    "node advertising a MIG slice, expect the taint of its group",
+			node:           newNode("mig", gpus(mig, 7)),
+			expectedTaints: []string{"mig=mixed:NoSchedule"},
+			expectedAdded:  1,
+		},
+		{
+			description:     "node tainted with another value of the group taint, expect the taint to be replaced",
+			node:            newNode("mig-other", gpus(mig, 7), corev1.Taint{Key: "mig", Value: "single", Effect: corev1.TaintEffectNoSchedule}),
+			expectedTaints:  []string{"mig=mixed:NoSchedule"},
+			expectedAdded:   1,
+			expectedRemoved: 1,
+		},
+		{
+			description:     "node which stopped advertising Nvidia GPU, expect the stale taints added by the tainter to be removed",
+			node:            newManagedNode(newNode("stale", gpus(nvidia, 0), unrelated, corev1.Taint{Key: nvidia, Effect: corev1.TaintEffectNoSchedule}, corev1.Taint{Key: nvidia, Effect: corev1.TaintEffectNoExecute}), nvidia+":NoExecute"),
+			expectedTaints:  []string{"dedicated=ml:NoSchedule", nvidia + ":NoSchedule"},
+			expectedRemoved: 1,
+		},
+		{
+			description:     "node tainted by the tainter for a resource whose rule was removed, expect the managed taint to be removed",
+			node:            newManagedNode(newNode("removed-rule", gpus(intel, 2), unrelated, corev1.Taint{Key: intel, Effect: corev1.TaintEffectNoSchedule}), intel+":NoSchedule"),
+			expectedTaints:  []string{"dedicated=ml:NoSchedule"},
+			expectedRemoved: 1,
+		},
+		{
+			description:    "node registered with the Nvidia GPU taint before advertising it, expect the taint to be kept",
+			node:           newNode("registering", corev1.ResourceList{corev1.ResourceCPU: *resource.NewQuantity(8, resource.DecimalSI)}, corev1.Taint{Key: nvidia, Effect: corev1.TaintEffectNoSchedule}),
+			expectedTaints: []string{nvidia + ":NoSchedule"},
+		},
+		{
+			description:    "node without extended resources, expect no change",
+			node:           newNode("cpu", corev1.ResourceList{corev1.ResourceCPU: *resource.NewQuantity(8, resource.DecimalSI)}, unrelated),
+			expectedTaints: []string{"dedicated=ml:NoSchedule"},
+		},
+	}
+
+	for _, test := range tests {
+		client := fake.NewSimpleClientset(test.node)
+		recorder := record.NewFakeRecorder(10)
+		tainter := NewNodeTainter(client, informers.NewSharedInformerFactory(client, 0).Core().V1().Nodes(), recorder)
+
+		change, err := tainter.SyncNode(test.node.Name)
+		if err != nil {
+			t.Errorf("Test (%s) Failed: unexpected error %v", test.description, err)
+			continue
+		}
+
+		node, err := client.CoreV1().Nodes().Get(context.TODO(), test.node.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if taints := taintStrings(node.Spec.Taints); !reflect.DeepEqual(taints, test.expectedTaints) {
+			t.Errorf("Test (%s) Failed: expected taints %v, got %v", test.description, test.expectedTaints, taints)
+		}
+		if len(change.Added) != test.expectedAdded || len(change.Removed) != test.expectedRemoved || len(recorder.Events) != test.expectedAdded+test.expectedRemoved {
+			t.Errorf("Test (%s) Failed: expected %d taints added and %d removed with an event each, got %v with %d events",
+				test.description, test.expectedAdded, test.expectedRemoved, change, len(recorder.Events))
+		}
+		for _, taint := range change.Added {
+			if !strings.Contains(node.Annotations[managedTaintsAnnotation], managedTaintKey(taint.Taint)) {
+				t.Errorf("Test (%s) Failed: expected the added taint %s to be recorded, got %q", test.description, taint.ToString(), node.Annotations[managedTaintsAnnotation])
+			}
+		}
+		for _, taint := range change.Removed {
+			if !hasNodeTaint(node.Spec.Taints, taint) && strings.Contains(node.Annotations[managedTaintsAnnotation], managedTaintKey(taint)) {
+				t.Errorf("Test (%s) Failed: expected the removed taint %s not to be recorded, got %q", test.description, taint.ToString(), node.Annotations[managedTaintsAnnotation])
+			}
+		}
+		for _, taint := range node.Spec.Taints {
+			if taint.Effect == corev1.TaintEffectNoExecute && taint.TimeAdded == nil {
+				t.Errorf("Test (%s) Failed: expected the time a NoExecute taint was added, got %v", test.description, taint)
+			}
+		}
+
+		change, err = tainter.SyncNode(test.node.Name)
+		if err != nil || !change.IsEmpty() {
+			t.Errorf("Test (%s) Failed: expected no change on resync, got %v (err: %v)", test.description, change, err)
+		}
+	}
+
+	client := fake.NewSimpleClientset()
+	tainter := NewNodeTainter(client, informers.NewSharedInformerFactory(client, 0).Core().V1().Nodes(), nil)
+	if change, err := tainter.SyncNode("missing"); err != nil || !change.IsEmpty() {
+		t.Errorf("Test (missing node) Failed: expected no change, got %v (err: %v)", change, err)
+	}
+}
+
+func TestRunNodeTainter(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+	SetTargetResourcesSet(ArrayFlags{nvidia + ":NoSchedule"})
+
+	client := fake.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+	tainter := NewNodeTainter(client, informerFactory.Core().V1().Nodes(), nil)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informerFactory.Start(stopCh)
+	go tainter.Run(1, stopCh)
+
+	node := newNode("gpu", corev1.ResourceList{corev1.ResourceName(nvidia): *resource.NewQuantity(1, resource.DecimalSI)})
+	if _, err := client.CoreV1().Nodes().Create(context.TODO(), node, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		node, err := client.CoreV1().Nodes().Get(context.TODO(), "gpu", metav1.GetOptions{})
+		return err == nil && len(node.Spec.Taints) == 1, err
+	})
+	if err != nil {
+		t.Errorf("expected the created node to be tainted: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package webhook
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	podKind         = "Pod"
+	replicaSetKind  = "ReplicaSet"
+	jobKind         = "Job"
+	deploymentKind  = "Deployment"
+	statefulSetKind = "StatefulSet"
+	daemonSetKind   = "DaemonSet"
+	cronJobKind     = "CronJob"
+)
+
+// WorkloadRef identifies the workload owning pods, the pod itself for pods
+// without a controller.
+type WorkloadRef struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+func (r WorkloadRef) String() string {
+	return r.Kind + "/" + r.Name
+}
+
+// ownerResolver follows controller references up to the workload managing an
+// object, e.g. from a pod to the Deployment of its ReplicaSet.
+type ownerResolver struct {
+	// client looks up the owners of ReplicaSets and Jobs which were not
+	// added, nil to only use the added ones.
+	client kubernetes.Interface
+	// owners are the owner references of the added objects, by
+	// "<kind>/<namespace>/<name>".
+	owners map[string][]metav1.OwnerReference
+}
+
+func newOwnerResolver(client kubernetes.Interface) *ownerResolver {
+	return &ownerResolver{
+		client: client,
+		owners: make(map[string][]metav1.OwnerReference),
+	}
+}
+
+// add records the owner references of an object.
+func (r *ownerResolver) add(kind string, meta *metav1.ObjectMeta) {
+	r.owners[ownerKey(kind, meta.Namespace, meta.Name)] = meta.OwnerReferences
+}
+
+// resolveWorkload follows the controller references of the object up to the
+// workload managing it, through ReplicaSets and Jobs. An owner which can not
+// be looked up is reported itself, an object without a controller is its own
+// workload.
+func (r *ownerResolver) resolveWorkload(kind string, meta *metav1.ObjectMeta) WorkloadRef {
+	workload := WorkloadRef{Kind: kind, Namespace: meta.Namespace, Name: meta.Name}
+	owners := meta.OwnerReferences
+
+	for {
+		owner := metav1.GetControllerOfNoCopy(&metav1.ObjectMeta{OwnerReferences: owners})
+		if owner == nil {
+			return workload
+		}
+		workload = WorkloadRef{Kind: owner.Kind, Namespace: meta.Namespace, Name: owner.Name}
+
+		if workload.Kind != replicaSetKind && workload.Kind != jobKind {
+			return workload
+		}
+		owners = r.getOwners(workload)
+	}
+}
+
+// getOwners returns the owner references of a ReplicaSet or Job.
+func (r *ownerResolver) getOwners(workload WorkloadRef) []metav1.OwnerReference {
+	if owners, ok := r.owners[ownerKey(workload.Kind, workload.Namespace, workload.Name)]; ok || r.client == nil {
+		return owners
+	}
+
+	var meta *metav1.ObjectMeta
+	switch workload.Kind {
+	case replicaSetKind:
+		replicaSet, err := r.client.AppsV1().ReplicaSets(workload.Namespace).Get(context.TODO(), workload.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil
+		}
+		meta = &replicaSet.ObjectMeta
+	case jobKind:
+		job, err := r.client.BatchV1().Jobs(workload.Namespace).Get(context.TODO(), workload.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil
+		}
+		meta = &job.ObjectMeta
+	default:
+		return nil
+	}
+
+	r.add(workload.Kind, meta)
+	return meta.OwnerReferences
+}
+
+func ownerKey(kind, namespace, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
@@ -0,0 +1,132 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// workloadKind describes where the pod, or the pod template of a workload, is
+// found within an object admitted by the webhooks.
+type workloadKind struct {
+	resource schema.GroupResource
+	kind     schema.GroupKind
+	// templateFields are the fields leading to the pod template, empty for
+	// pods themselves.
+	templateFields []string
+	// immutableTemplate is set for workloads whose pod template can not be
+	// updated once created.
+	immutableTemplate bool
+}
+
+// workloadKinds are the kinds whose pods are checked. Versions are not
+// compared, as the pod template is found at the same fields in every version
+// served, e.g. batch/v1beta1 and batch/v1 CronJobs.
+var workloadKinds = []workloadKind{
+	{resource: schema.GroupResource{Resource: "pods"}, kind: schema.GroupKind{Kind: "Pod"}},
+	{resource: schema.GroupResource{Group: "apps", Resource: "deployments"}, kind: schema.GroupKind{Group: "apps", Kind: "Deployment"}, templateFields: []string{"spec", "template"}},
+	{resource: schema.GroupResource{Group: "apps", Resource: "statefulsets"}, kind: schema.GroupKind{Group: "apps", Kind: "StatefulSet"}, templateFields: []string{"spec", "template"}},
+	{resource: schema.GroupResource{Group: "apps", Resource: "daemonsets"}, kind: schema.GroupKind{Group: "apps", Kind: "DaemonSet"}, templateFields: []string{"spec", "template"}},
+	{resource: schema.GroupResource{Group: "apps", Resource: "replicasets"}, kind: schema.GroupKind{Group: "apps", Kind: "ReplicaSet"}, templateFields: []string{"spec", "template"}},
+	{resource: schema.GroupResource{Group: "batch", Resource: "jobs"}, kind: schema.GroupKind{Group: "batch", Kind: "Job"}, templateFields: []string{"spec", "template"}, immutableTemplate: true},
+	{resource: schema.GroupResource{Group: "batch", Resource: "cronjobs"}, kind: schema.GroupKind{Group: "batch", Kind: "CronJob"}, templateFields: []string{"spec", "jobTemplate", "spec", "template"}},
+}
+
+// podTemplate is the pod, or the pod template of a workload, of an admitted
+// object.
+type podTemplate struct {
+	// Pod holds the metadata and spec of the pod template.
+	Pod corev1.Pod
+	// Path is the JSON pointer to the pod template within the object, empty
+	// for pods themselves.
+	Path string
+	// Immutable is set for the pod templates of workloads which reject any
+	// update of them, such as Jobs.
+	Immutable bool
+}
+
+// isTemplate reports whether the pod is the pod template of a workload.
+func (t *podTemplate) isTemplate() bool {
+	return t.Path != ""
+}
+
+// tolerationsPath returns the field path of the tolerations of the pod
+// template within the object.
+func (t *podTemplate) tolerationsPath() *field.Path {
+	path := field.NewPath("spec")
+	if t.isTemplate() {
+		fields := strings.Split(strings.TrimPrefix(t.Path, "/"), "/")
+		path = field.NewPath(fields[0], fields[1:]...).Child("spec")
+	}
+
+	return path.Child("tolerations")
+}
+
+// getWorkloadKind returns the kind of the admitted object. The resource is
+// preferred, the kind is only used when the request does not name a resource.
+func getWorkloadKind(req *admissionv1.AdmissionRequest) (workloadKind, bool) {
+	for _, workload := range workloadKinds {
+		if req.Resource.Resource != "" {
+			if req.Resource.Group == workload.resource.Group && req.Resource.Resource == workload.resource.Resource {
+				return workload, true
+			}
+		} else if req.Kind.Group == workload.kind.Group && req.Kind.Kind == workload.kind.Kind {
+			return workload, true
+		}
+	}
+
+	return workloadKind{}, false
+}
+
+// getPodTemplate extracts the pod, or the pod template of a workload, from the
+// admitted object. It returns nil for objects of any other kind.
+func getPodTemplate(req *admissionv1.AdmissionRequest) (*podTemplate, error) {
+	workload, ok := getWorkloadKind(req)
+	if !ok {
+		return nil, nil
+	}
+
+	raw := req.Object.Raw
+	for _, name := range workload.templateFields {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, fmt.Errorf("could not deserialize %s object: %v", workload.kind.Kind, err)
+		}
+		raw = fields[name]
+		if raw == nil {
+			return nil, fmt.Errorf("%s object has no %s", workload.kind.Kind, strings.Join(workload.templateFields, "."))
+		}
+	}
+
+	template := &podTemplate{}
+	if err := json.Unmarshal(raw, &template.Pod); err != nil {
+		return nil, fmt.Errorf("could not deserialize %s object: %v", workload.kind.Kind, err)
+	}
+	if len(workload.templateFields) != 0 {
+		template.Path = "/" + strings.Join(workload.templateFields, "/")
+		template.Immutable = workload.immutableTemplate
+		// Pod templates carry no name, report the workload instead.
+		template.Pod.Name = req.Name
+		template.Pod.Namespace = req.Namespace
+	}
+
+	return template, nil
+}
+
+// getOldPodTemplate extracts the pod, or the pod template of a workload, from
+// the object being replaced by an UPDATE request. It returns nil for other
+// operations and objects of any other kind.
+func getOldPodTemplate(req *admissionv1.AdmissionRequest) (*podTemplate, error) {
+	if req.Operation != admissionv1.Update || len(req.OldObject.Raw) == 0 {
+		return nil, nil
+	}
+
+	oldReq := *req
+	oldReq.Object = req.OldObject
+	return getPodTemplate(&oldReq)
+}
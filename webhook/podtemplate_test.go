@@ -0,0 +1,193 @@
+package webhook
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	jsonpatch "github.com/evanphx/json-patch"
+)
+
+// newWorkloadRequest returns an admission request for the workload of the
+// given resource, whose pod template is the given pod.
+func newWorkloadRequest(t *testing.T, group, version, resource string, pod corev1.Pod) *admissionv1.AdmissionRequest {
+	template := corev1.PodTemplateSpec{ObjectMeta: pod.ObjectMeta, Spec: pod.Spec}
+
+	var object interface{}
+	switch resource {
+	case "pods":
+		object = pod
+	case "deployments":
+		object = appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: template}}
+	case "statefulsets":
+		object = appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{Template: template}}
+	case "daemonsets":
+		object = appsv1.DaemonSet{Spec: appsv1.DaemonSetSpec{Template: template}}
+	case "replicasets":
+		object = appsv1.ReplicaSet{Spec: appsv1.ReplicaSetSpec{Template: template}}
+	case "jobs":
+		object = batchv1.Job{Spec: batchv1.JobSpec{Template: template}}
+	case "cronjobs":
+		object = batchv1beta1.CronJob{Spec: batchv1beta1.CronJobSpec{JobTemplate: batchv1beta1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: template}}}}
+	default:
+		object = map[string]string{}
+	}
+
+	data, err := json.Marshal(object)
+	if err != nil {
+		t.Fatalf("marshaling %s: %v", resource, err)
+	}
+
+	return &admissionv1.AdmissionRequest{
+		Name:      "workload",
+		Namespace: "default",
+		Resource:  metav1.GroupVersionResource{Group: group, Version: version, Resource: resource},
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: data},
+	}
+}
+
+func TestGetPodTemplate(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+	SetTargetResourcesSet(ArrayFlags{nvidia})
+
+	gpuToleration := corev1.Toleration{Key: nvidia, Operator: corev1.TolerationOpExists}
+
+	tests := []struct {
+		description  string
+		group        string
+		version      string
+		resource     string
+		expectedPath string
+	}{
+		{"pod", "", "v1", "pods", ""},
+		{"apps/v1 deployment", "apps", "v1", "deployments", "/spec/template"},
+		{"apps/v1 statefulset", "apps", "v1", "statefulsets", "/spec/template"},
+		{"apps/v1 daemonset", "apps", "v1", "daemonsets", "/spec/template"},
+		{"apps/v1 replicaset", "apps", "v1", "replicasets", "/spec/template"},
+		{"batch/v1 job", "batch", "v1", "jobs", "/spec/template"},
+		{"batch/v1beta1 cronjob", "batch", "v1beta1", "cronjobs", "/spec/jobTemplate/spec/template"},
+		{"batch/v1 cronjob", "batch", "v1", "cronjobs", "/spec/jobTemplate/spec/template"},
+	}
+
+	for _, test := range tests {
+		t.Logf("\tTest: %v", test.description)
+		gpuPod := newPodRequesting(nvidia, gpuToleration)
+		nonGpuPod := newPodRequesting("", gpuToleration)
+
+		template, err := getPodTemplate(newWorkloadRequest(t, test.group, test.version, test.resource, gpuPod))
+		if err != nil || template == nil {
+			t.Errorf("\t%s\tunexpected result: got %v (err: %v)", failed, template, err)
+			continue
+		}
+		if template.Path != test.expectedPath || len(template.Pod.Spec.Containers) != 1 || len(template.Pod.Spec.Tolerations) != 1 {
+			t.Errorf("\t%s\texpected the pod template at %q, got %q with %v", failed, test.expectedPath, template.Path, template.Pod.Spec)
+		}
+
+		if _, err := validateExtendResources(newWorkloadRequest(t, test.group, test.version, test.resource, gpuPod)); err != nil {
+			t.Errorf("\t%s\texpected a template with Nvidia GPU to be allowed, got %v", failed, err)
+		}
+		if _, err := validateExtendResources(newWorkloadRequest(t, test.group, test.version, test.resource, nonGpuPod)); err == nil {
+			t.Errorf("\t%s\texpected a template with no extended resources which has Nvidia tolerations to be denied", failed)
+		} else {
+			t.Logf("\t%s\treturned: %v.", succeed, err)
+		}
+	}
+
+	other := newWorkloadRequest(t, "", "v1", "configmaps", corev1.Pod{})
+	if template, err := getPodTemplate(other); template != nil || err != nil {
+		t.Errorf("\t%s\texpected no pod template in a configmap, got %v (err: %v)", failed, template, err)
+	}
+
+	scale := newWorkloadRequest(t, "apps", "v1", "deployments", newPodRequesting("", gpuToleration))
+	scale.SubResource = "scale"
+	if _, err := validateExtendResources(scale); err != nil {
+		t.Errorf("\t%s\texpected the scale subresource to be allowed, got %v", failed, err)
+	}
+
+	ar := &admissionv1.AdmissionReview{Request: newWorkloadRequest(t, "apps", "v1", "deployments", newPodRequesting(nvidia))}
+	if response := mutate(ar); !response.Allowed || response.Patch != nil || response.AuditAnnotations[matchedRulesAnnotationKey] != nvidia+"="+nvidia {
+		t.Errorf("\t%s\texpected the deployment to be allowed unpatched with its matched rules, got %v", failed, response)
+	}
+}
+
+func TestMutatePodTemplates(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+	SetTargetResourcesSet(ArrayFlags{nvidia})
+
+	SetMutatePodTemplates(true)
+	defer SetMutatePodTemplates(false)
+
+	otherToleration := corev1.Toleration{Key: "foo", Operator: corev1.TolerationOpEqual, Value: "bar", Effect: corev1.TaintEffectNoSchedule}
+	expected := newTolerationSet(newExistsTolerations(nvidia, DefaultTolerationEffects...))
+
+	tests := []struct {
+		description   string
+		group         string
+		version       string
+		resource      string
+		tolerations   []corev1.Toleration
+		expectedPaths []string
+	}{
+		{"pod without tolerations", "", "v1", "pods", nil, []string{"/spec/tolerations"}},
+		{"deployment without tolerations", "apps", "v1", "deployments", nil, []string{"/spec/template/spec/tolerations"}},
+		{"statefulset with other tolerations", "apps", "v1", "statefulsets", []corev1.Toleration{otherToleration}, []string{"/spec/template/spec/tolerations/-", "/spec/template/spec/tolerations/-"}},
+		{"daemonset without tolerations", "apps", "v1", "daemonsets", nil, []string{"/spec/template/spec/tolerations"}},
+		{"replicaset without tolerations", "apps", "v1", "replicasets", nil, []string{"/spec/template/spec/tolerations"}},
+		{"job with other tolerations", "batch", "v1", "jobs", []corev1.Toleration{otherToleration}, []string{"/spec/template/spec/tolerations/-", "/spec/template/spec/tolerations/-"}},
+		{"cronjob without tolerations", "batch", "v1beta1", "cronjobs", nil, []string{"/spec/jobTemplate/spec/template/spec/tolerations"}},
+		{"cronjob with other tolerations", "batch", "v1", "cronjobs", []corev1.Toleration{otherToleration}, []string{"/spec/jobTemplate/spec/template/spec/tolerations/-", "/spec/jobTemplate/spec/template/spec/tolerations/-"}},
+	}
+
+	for _, test := range tests {
+		t.Logf("\tTest: %v", test.description)
+		req := newWorkloadRequest(t, test.group, test.version, test.resource, newPodRequesting(nvidia, test.tolerations...))
+
+		response := mutate(&admissionv1.AdmissionReview{Request: req})
+		if !response.Allowed || response.Patch == nil {
+			t.Errorf("\t%s\texpected a patch, got %v", failed, response)
+			continue
+		}
+
+		var patch []PatchOps
+		if err := json.Unmarshal(response.Patch, &patch); err != nil {
+			t.Fatalf("decoding patch: %v", err)
+		}
+		var paths []string
+		for _, op := range patch {
+			paths = append(paths, op.Path)
+		}
+		if !reflect.DeepEqual(paths, test.expectedPaths) {
+			t.Errorf("\t%s\texpected patch paths %v, got %v", failed, test.expectedPaths, paths)
+		}
+
+		decodedPatch, err := jsonpatch.DecodePatch(response.Patch)
+		if err != nil {
+			t.Fatalf("decoding patch: %v", err)
+		}
+		patched, err := decodedPatch.Apply(req.Object.Raw)
+		if err != nil {
+			t.Errorf("\t%s\tpatch does not apply to the %s: %v", failed, test.resource, err)
+			continue
+		}
+
+		req.Object.Raw = patched
+		template, err := getPodTemplate(req)
+		if err != nil {
+			t.Fatalf("extracting pod template: %v", err)
+		}
+		if tolerations := newTolerationSet(template.Pod.Spec.Tolerations); !expected.IsSubset(tolerations) || tolerations.Cardinality() != expected.Cardinality()+len(test.tolerations) {
+			t.Errorf("\t%s\texpected the tolerations to be added to %v, got %v", failed, test.tolerations, template.Pod.Spec.Tolerations)
+		} else {
+			t.Logf("\t%s\tpatched tolerations: %v.", succeed, template.Pod.Spec.Tolerations)
+		}
+	}
+}
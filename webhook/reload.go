@@ -0,0 +1,145 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// ConfigWatcher loads the configuration file and reloads it when its content
+// changes, e.g. when the mounted ConfigMap is updated. An invalid file never
+// replaces the active rule set.
+type ConfigWatcher struct {
+	path                string
+	targetResourceFlags ArrayFlags
+	interval            time.Duration
+
+	lastData []byte
+
+	mu sync.RWMutex
+	// loaded is set once a valid file has been activated.
+	loaded bool
+}
+
+// lastConfigError is the error of the last load of the configuration file,
+// reported by /config, empty if it was valid.
+var lastConfigError atomic.Value
+
+// NewConfigWatcher returns a watcher of the configuration file at path. The
+// -targetResource flags are added to the file on every load.
+func NewConfigWatcher(path string, targetResourceFlags ArrayFlags, interval time.Duration) *ConfigWatcher {
+	return &ConfigWatcher{
+		path:                path,
+		targetResourceFlags: targetResourceFlags,
+		interval:            interval,
+	}
+}
+
+// Load reads and validates the configuration file and activates it. On error
+// the active rule set is kept.
+func (w *ConfigWatcher) Load() error {
+	err := w.load()
+	if err != nil {
+		lastConfigError.Store(err.Error())
+		return err
+	}
+	lastConfigError.Store("")
+
+	w.mu.Lock()
+	w.loaded = true
+	w.mu.Unlock()
+
+	return nil
+}
+
+// Ready fails until a valid configuration file has been loaded. Later invalid
+// files keep the last valid rule set active, and are only reported by the
+// logs and /config, so that a broken ConfigMap does not take every replica
+// out of service.
+func (w *ConfigWatcher) Ready() error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if !w.loaded {
+		return fmt.Errorf("no valid config file %s loaded", w.path)
+	}
+	return nil
+}
+
+func (w *ConfigWatcher) load() error {
+	data, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %v", err)
+	}
+	w.lastData = data
+
+	config, err := ParseConfig(data)
+	if err != nil {
+		return fmt.Errorf("could not parse config file %s: %v", w.path, err)
+	}
+	config.AddTargetResourceFlags(w.targetResourceFlags)
+
+	ruleSet, err := config.NewRuleSet()
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %v", w.path, err)
+	}
+
+	SetActiveRuleSet(ruleSet)
+	klog.Infof("Loaded config %s, version %s", w.path, ruleSet.Version)
+
+	return nil
+}
+
+// Run checks the configuration file every interval until stopCh is closed,
+// reloading it when its content changed.
+func (w *ConfigWatcher) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			data, err := ioutil.ReadFile(w.path)
+			if err != nil {
+				klog.Errorf("Could not read config file %s, keeping config version %s: %v", w.path, GetActiveRuleSet().Version, err)
+				continue
+			}
+
+			if bytes.Equal(data, w.lastData) {
+				continue
+			}
+
+			if err := w.Load(); err != nil {
+				klog.Errorf("Could not reload config, keeping config version %s: %v", GetActiveRuleSet().Version, err)
+			}
+		}
+	}
+}
+
+// HandleConfig reports the active rule set and its version, and the error of
+// the last load of the configuration file if it failed.
+func HandleConfig(w http.ResponseWriter, r *http.Request) {
+	lastError, _ := lastConfigError.Load().(string)
+	data, err := json.Marshal(struct {
+		*RuleSet
+		LastError string `json:"lastError,omitempty"`
+	}{GetActiveRuleSet(), lastError})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("couldn't encode config: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	if _, err := w.Write(data); err != nil {
+		klog.Errorf("Could not write response: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	gpuConfig = `
+apiVersion: gpu-resource-toleration-admission-controller/v1alpha1
+kind: TolerationConfiguration
+resources:
+- name: nvidia.com/gpu
+`
+	gpuAndFpgaConfig = `
+apiVersion: gpu-resource-toleration-admission-controller/v1alpha1
+kind: TolerationConfiguration
+resources:
+- name: nvidia.com/gpu
+- name: xilinx.com/fpga
+`
+	invalidConfig = `
+apiVersion: gpu-resource-toleration-admission-controller/v1alpha1
+kind: TolerationConfiguration
+resources:
+- name: amd.com/gpu
+  effects: [NoRun]
+`
+)
+
+func TestConfigWatcherLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	writeConfig := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig(invalidConfig)
+	watcher := NewConfigWatcher(path, ArrayFlags{"amd.com/gpu"}, time.Hour)
+	if err := watcher.Load(); err == nil {
+		t.Errorf("expected loading invalid config to fail")
+	}
+	if err := watcher.Ready(); err == nil {
+		t.Errorf("expected the watcher not to be ready before a valid config is loaded")
+	}
+
+	writeConfig(gpuConfig)
+	if err := watcher.Load(); err != nil {
+		t.Fatalf("loading valid config failed: %v", err)
+	}
+
+	firstVersion := GetActiveRuleSet().Version
+	if !(*GetTargetResourcesSet()).Contains("nvidia.com/gpu") || !(*GetTargetResourcesSet()).Contains("amd.com/gpu") {
+		t.Errorf("expected config file and flag resources to be active, got %v", GetActiveRuleSet().Resources)
+	}
+
+	writeConfig(invalidConfig)
+	if err := watcher.Load(); err == nil {
+		t.Errorf("expected loading invalid config to fail")
+	}
+	if err := watcher.Ready(); err != nil {
+		t.Errorf("expected the watcher to stay ready with the previous config, got %v", err)
+	}
+	rr := httptest.NewRecorder()
+	HandleConfig(rr, httptest.NewRequest(http.MethodGet, "/config", nil))
+	if !strings.Contains(rr.Body.String(), `"lastError":"invalid config file`) {
+		t.Errorf("expected /config to report the reload error, got %s", rr.Body.String())
+	}
+	if GetActiveRuleSet().Version != firstVersion {
+		t.Errorf("expected invalid config to keep version %s, got %s", firstVersion, GetActiveRuleSet().Version)
+	}
+
+	writeConfig(gpuAndFpgaConfig)
+	if err := watcher.Load(); err != nil {
+		t.Fatalf("loading valid config failed: %v", err)
+	}
+	rr = httptest.NewRecorder()
+	HandleConfig(rr, httptest.NewRequest(http.MethodGet, "/config", nil))
+	if strings.Contains(rr.Body.String(), "lastError") {
+		t.Errorf("expected /config to clear the reload error once the config is fixed, got %s", rr.Body.String())
+	}
+	if GetActiveRuleSet().Version == firstVersion || !(*GetTargetResourcesSet()).Contains("xilinx.com/fpga") {
+		t.Errorf("expected new config to be active, got version %s with %v", GetActiveRuleSet().Version, GetActiveRuleSet().Resources)
+	}
+}
+
+func TestConfigWatcherRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(gpuConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	watcher := NewConfigWatcher(path, nil, 10*time.Millisecond)
+	if err := watcher.Load(); err != nil {
+		t.Fatalf("loading valid config failed: %v", err)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go watcher.Run(stopCh)
+
+	if err := ioutil.WriteFile(path, []byte(gpuAndFpgaConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !(*GetTargetResourcesSet()).Contains("xilinx.com/fpga") {
+		if time.Now().After(deadline) {
+			t.Fatalf("config was not reloaded, active resources: %v", GetActiveRuleSet().Resources)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rr := httptest.NewRecorder()
+	HandleConfig(rr, httptest.NewRequest(http.MethodGet, "/config", nil))
+
+	var reported RuleSet
+	if err := json.Unmarshal(rr.Body.Bytes(), &reported); err != nil {
+		t.Fatalf("could not decode /config response: %v", err)
+	}
+	if reported.Version != GetActiveRuleSet().Version || len(reported.Resources) != 2 {
+		t.Errorf("expected /config to report the active rule set, got %s", rr.Body.String())
+	}
+}
@@ -0,0 +1,107 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	admissionReviewV1GVK      = admissionv1.SchemeGroupVersion.WithKind("AdmissionReview")
+	admissionReviewV1beta1GVK = admissionv1beta1.SchemeGroupVersion.WithKind("AdmissionReview")
+)
+
+// decodeAdmissionReview decodes an AdmissionReview sent as either v1 or
+// v1beta1. The review is converted to v1 for internal use and the version it
+// was sent in is returned, so that the response is answered in the same
+// version. Reviews without a recognized apiVersion are read as v1.
+func decodeAdmissionReview(body []byte) (*admissionv1.AdmissionReview, schema.GroupVersionKind, error) {
+	var typeMeta metav1.TypeMeta
+	if err := json.Unmarshal(body, &typeMeta); err != nil {
+		return nil, admissionReviewV1GVK, fmt.Errorf("could not read AdmissionReview type: %v", err)
+	}
+
+	if typeMeta.APIVersion == admissionv1beta1.SchemeGroupVersion.String() {
+		var review admissionv1beta1.AdmissionReview
+		if _, _, err := Deserializer.Decode(body, nil, &review); err != nil {
+			return nil, admissionReviewV1beta1GVK, err
+		}
+
+		return &admissionv1.AdmissionReview{Request: convertRequestFromV1beta1(review.Request)}, admissionReviewV1beta1GVK, nil
+	}
+
+	var review admissionv1.AdmissionReview
+	if _, _, err := Deserializer.Decode(body, nil, &review); err != nil {
+		return nil, admissionReviewV1GVK, err
+	}
+
+	return &review, admissionReviewV1GVK, nil
+}
+
+// encodeAdmissionReview wraps the response into an AdmissionReview of the
+// given version, with its TypeMeta set, and marshals it.
+func encodeAdmissionReview(gvk schema.GroupVersionKind, response *admissionv1.AdmissionResponse) ([]byte, error) {
+	typeMeta := metav1.TypeMeta{APIVersion: gvk.GroupVersion().String(), Kind: gvk.Kind}
+
+	if gvk == admissionReviewV1beta1GVK {
+		return json.Marshal(admissionv1beta1.AdmissionReview{
+			TypeMeta: typeMeta,
+			Response: convertResponseToV1beta1(response),
+		})
+	}
+
+	return json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: typeMeta,
+		Response: response,
+	})
+}
+
+func convertRequestFromV1beta1(req *admissionv1beta1.AdmissionRequest) *admissionv1.AdmissionRequest {
+	if req == nil {
+		return nil
+	}
+
+	return &admissionv1.AdmissionRequest{
+		UID:                req.UID,
+		Kind:               req.Kind,
+		Resource:           req.Resource,
+		SubResource:        req.SubResource,
+		RequestKind:        req.RequestKind,
+		RequestResource:    req.RequestResource,
+		RequestSubResource: req.RequestSubResource,
+		Name:               req.Name,
+		Namespace:          req.Namespace,
+		Operation:          admissionv1.Operation(req.Operation),
+		UserInfo:           req.UserInfo,
+		Object:             req.Object,
+		OldObject:          req.OldObject,
+		DryRun:             req.DryRun,
+		Options:            req.Options,
+	}
+}
+
+func convertResponseToV1beta1(resp *admissionv1.AdmissionResponse) *admissionv1beta1.AdmissionResponse {
+	if resp == nil {
+		return nil
+	}
+
+	var patchType *admissionv1beta1.PatchType
+	if resp.PatchType != nil {
+		pt := admissionv1beta1.PatchType(*resp.PatchType)
+		patchType = &pt
+	}
+
+	return &admissionv1beta1.AdmissionResponse{
+		UID:              resp.UID,
+		Allowed:          resp.Allowed,
+		Result:           resp.Result,
+		Patch:            resp.Patch,
+		PatchType:        patchType,
+		AuditAnnotations: resp.AuditAnnotations,
+		Warnings:         resp.Warnings,
+	}
+}
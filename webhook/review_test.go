@@ -0,0 +1,154 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestAdmissionReviewVersions(t *testing.T) {
+	uid := types.UID("5A7C1E")
+	nvidia := "nvidia.com/gpu"
+
+	var targetResources ArrayFlags
+	targetResources.Set(nvidia)
+	SetTargetResourcesSet(targetResources)
+
+	gpuPod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{
+							corev1.ResourceName(nvidia): *resource.NewQuantity(1, resource.DecimalSI),
+						},
+					},
+				},
+			},
+		},
+	}
+	nonGpuPodWithGpuTolerations := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Tolerations: getTolerationObject(nvidia),
+		},
+	}
+
+	v1Review := func(pod corev1.Pod) interface{} {
+		return admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+			Request:  &admissionv1.AdmissionRequest{UID: uid, Resource: podResource, Operation: admissionv1.Create, Object: runtime.RawExtension{Raw: marshal(pod)}},
+		}
+	}
+	v1beta1Review := func(pod corev1.Pod) interface{} {
+		return admissionv1beta1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"},
+			Request:  &admissionv1beta1.AdmissionRequest{UID: uid, Resource: podResource, Operation: admissionv1beta1.Create, Object: runtime.RawExtension{Raw: marshal(pod)}},
+		}
+	}
+
+	cases := []struct {
+		description        string
+		path               string
+		handler            http.HandlerFunc
+		in                 interface{}
+		expectedAPIVersion string
+		expectedAllowed    bool
+		expectedPatch      bool
+	}{
+		{
+			description:        "v1 mutation of a gpu pod",
+			path:               "/mutate",
+			handler:            HandleMutate,
+			in:                 v1Review(gpuPod),
+			expectedAPIVersion: "admission.k8s.io/v1",
+			expectedAllowed:    true,
+			expectedPatch:      true,
+		},
+		{
+			description:        "v1beta1 mutation of a gpu pod",
+			path:               "/mutate",
+			handler:            HandleMutate,
+			in:                 v1beta1Review(gpuPod),
+			expectedAPIVersion: "admission.k8s.io/v1beta1",
+			expectedAllowed:    true,
+			expectedPatch:      true,
+		},
+		{
+			description:        "v1 validation of a non gpu pod with gpu tolerations",
+			path:               "/validate",
+			handler:            HandleValidate,
+			in:                 v1Review(nonGpuPodWithGpuTolerations),
+			expectedAPIVersion: "admission.k8s.io/v1",
+			expectedAllowed:    false,
+		},
+		{
+			description:        "v1beta1 validation of a non gpu pod with gpu tolerations",
+			path:               "/validate",
+			handler:            HandleValidate,
+			in:                 v1beta1Review(nonGpuPodWithGpuTolerations),
+			expectedAPIVersion: "admission.k8s.io/v1beta1",
+			expectedAllowed:    false,
+		},
+		{
+			description:        "v1beta1 validation of a gpu pod",
+			path:               "/validate",
+			handler:            HandleValidate,
+			in:                 v1beta1Review(gpuPod),
+			expectedAPIVersion: "admission.k8s.io/v1beta1",
+			expectedAllowed:    true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("\tTest: %v", c.description)
+		pbytes, err := json.Marshal(c.in)
+		if err != nil {
+			t.Fatalf("marshaling request: %v", err)
+		}
+
+		req, err := http.NewRequest("POST", c.path, bytes.NewBuffer(pbytes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := httptest.NewRecorder()
+		c.handler.ServeHTTP(rr, req)
+
+		// The v1beta1 and v1 responses share the same JSON layout, so the
+		// response is read generically after checking the TypeMeta.
+		var typeMeta metav1.TypeMeta
+		if err := json.Unmarshal(rr.Body.Bytes(), &typeMeta); err != nil {
+			t.Errorf("\t%s\tcould not read response type: %v", failed, err)
+			continue
+		}
+		if typeMeta.APIVersion != c.expectedAPIVersion || typeMeta.Kind != "AdmissionReview" {
+			t.Errorf("\t%s\tunexpected response type: got %s/%s want %s/AdmissionReview", failed,
+				typeMeta.APIVersion, typeMeta.Kind, c.expectedAPIVersion)
+		}
+
+		var admissionReview admissionv1.AdmissionReview
+		if err := json.Unmarshal(rr.Body.Bytes(), &admissionReview); err != nil || admissionReview.Response == nil {
+			t.Errorf("\t%s\tcould not read response: %v", failed, err)
+			continue
+		}
+
+		response := admissionReview.Response
+		if response.UID != uid || response.Allowed != c.expectedAllowed || (response.Patch != nil) != c.expectedPatch {
+			t.Errorf("\t%s\tunexpected response: got uid %s, allowed %v, patch %s", failed,
+				response.UID, response.Allowed, string(response.Patch))
+		} else {
+			t.Logf("\t%s\thandler returned: %v.", succeed, response.Allowed)
+		}
+	}
+}
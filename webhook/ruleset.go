@@ -0,0 +1,192 @@
+package webhook
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mapset "github.com/deckarep/golang-set"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// RuleSet is a validated configuration as used by the webhooks. A rule set is
+// never modified once built; a reload builds a new one and swaps it in.
+//
+// When several rules match a resource name, an exact name wins over a glob
+// pattern, which wins over a regular expression. Among glob patterns the one
+// with the most non-wildcard characters wins, and remaining ties as well as
+// regular expressions are decided by the order of the configuration.
+type RuleSet struct {
+	// Version identifies the content of the rule set, so that replicas
+	// running the same configuration report the same version.
+	Version   string           `json:"version"`
+	LoadedAt  time.Time        `json:"loadedAt"`
+	Resources []TargetResource `json:"resources"`
+	// Namespaces selects the namespaces the rules apply to.
+	Namespaces *NamespacePolicy `json:"namespaces,omitempty"`
+
+	names     mapset.Set
+	resources map[string]TargetResource
+	globs     []TargetResource
+	regexes   []regexRule
+	// taintKeys are the configured taint keys other than resource names.
+	taintKeys mapset.Set
+	// taints are the taints guarded by every rule.
+	taints     []guardedTaint
+	namespaces *namespaceSelector
+}
+
+type regexRule struct {
+	resource TargetResource
+	regex    *regexp.Regexp
+}
+
+var activeRuleSet atomic.Value
+
+func init() {
+	SetActiveRuleSet(NewRuleSet(nil))
+}
+
+// NewRuleSet indexes the given target resources, which must be validated.
+// The rules apply to every namespace.
+func NewRuleSet(resources []TargetResource) *RuleSet {
+	return newRuleSet(resources, nil)
+}
+
+func newRuleSet(resources []TargetResource, namespaces *NamespacePolicy) *RuleSet {
+	ruleSet := &RuleSet{
+		LoadedAt:   time.Now(),
+		Resources:  resources,
+		Namespaces: namespaces,
+		names:      mapset.NewSet(),
+		resources:  make(map[string]TargetResource),
+		taintKeys:  mapset.NewSet(),
+		namespaces: newNamespaceSelector(namespaces),
+	}
+
+	for _, resource := range resources {
+		switch {
+		case resource.NameRegex != "":
+			regex, err := compileNameRegex(resource.NameRegex)
+			if err != nil {
+				panic(err)
+			}
+			ruleSet.regexes = append(ruleSet.regexes, regexRule{resource: resource, regex: regex})
+		case isGlobPattern(resource.Name):
+			ruleSet.globs = append(ruleSet.globs, resource)
+		default:
+			ruleSet.names.Add(resource.Name)
+			ruleSet.resources[resource.Name] = resource
+		}
+
+		for _, key := range resource.TaintKeys() {
+			ruleSet.taintKeys.Add(key)
+		}
+		ruleSet.taints = append(ruleSet.taints, resource.guardedTaints()...)
+	}
+
+	sort.SliceStable(ruleSet.globs, func(i, j int) bool {
+		return globLiteralLength(ruleSet.globs[i].Name) > globLiteralLength(ruleSet.globs[j].Name)
+	})
+
+	data, _ := json.Marshal(resources)
+	if namespaces != nil {
+		namespacesData, _ := json.Marshal(namespaces)
+		data = append(data, namespacesData...)
+	}
+	sum := sha256.Sum256(data)
+	ruleSet.Version = hex.EncodeToString(sum[:])[:12]
+
+	return ruleSet
+}
+
+// Match returns the rule of highest precedence matching the resource name.
+func (r *RuleSet) Match(resourceName string) (TargetResource, bool) {
+	if resource, ok := r.resources[resourceName]; ok {
+		return resource, true
+	}
+
+	for _, resource := range r.globs {
+		if matched, _ := path.Match(resource.Name, resourceName); matched {
+			return resource, true
+		}
+	}
+
+	for _, rule := range r.regexes {
+		if rule.regex.MatchString(resourceName) {
+			return rule.resource, true
+		}
+	}
+
+	return TargetResource{}, false
+}
+
+// isTargetTaintKey reports whether the taint key is the key of a target
+// resource taint, either configured or the name of a matched resource.
+func (r *RuleSet) isTargetTaintKey(key string) bool {
+	if r.taintKeys.Contains(key) {
+		return true
+	}
+
+	resource, ok := r.Match(key)
+	return ok && resource.toleratesResourceName()
+}
+
+// exemptionReason returns why the rules do not apply to the namespace, or an
+// empty string if they do.
+func (r *RuleSet) exemptionReason(namespace string) string {
+	return r.namespaces.exemptionReason(namespace)
+}
+
+// taintsToleratedBy returns the taints of every rule the toleration may
+// tolerate. A taint keyed by the resource names a pattern matches is keyed by
+// the toleration key when that is a resource name matched by the rule, and by
+// the pattern for a toleration without a key, which tolerates them all.
+func (r *RuleSet) taintsToleratedBy(toleration corev1.Toleration) []guardedTaint {
+	var taints []guardedTaint
+
+	for _, taint := range r.taints {
+		if taint.resourceNameKey {
+			switch {
+			case toleration.Key == "":
+				taint = taint.forResource(taint.resource.matchExpression())
+			case isPatternRule(taint.resource):
+				resource, ok := r.Match(toleration.Key)
+				if !ok || resource.Rule() != taint.resource.Rule() {
+					continue
+				}
+				taint = taint.forResource(toleration.Key)
+			}
+		}
+
+		if mayTolerate(toleration, taint) {
+			taints = append(taints, taint)
+		}
+	}
+
+	return taints
+}
+
+func isPatternRule(resource TargetResource) bool {
+	return resource.NameRegex != "" || isGlobPattern(resource.Name)
+}
+
+func globLiteralLength(pattern string) int {
+	return len(pattern) - strings.Count(pattern, "*") - strings.Count(pattern, "?")
+}
+
+// SetActiveRuleSet atomically replaces the rule set used by the webhooks.
+func SetActiveRuleSet(ruleSet *RuleSet) {
+	activeRuleSet.Store(ruleSet)
+}
+
+// GetActiveRuleSet returns the rule set currently used by the webhooks.
+func GetActiveRuleSet() *RuleSet {
+	return activeRuleSet.Load().(*RuleSet)
+}
@@ -0,0 +1,143 @@
+package webhook
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func newRuleSetFromConfig(t *testing.T, resourceConfigs ...ResourceConfig) *RuleSet {
+	config := NewConfig()
+	config.Resources = resourceConfigs
+
+	resources, err := config.Validate()
+	if err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+
+	return NewRuleSet(resources)
+}
+
+func TestRuleSetMatch(t *testing.T) {
+	ruleSet := newRuleSetFromConfig(t,
+		ResourceConfig{NameRegex: `[a-z.]+\.com/[a-z-]*gpu`},
+		ResourceConfig{Name: "nvidia.com/*"},
+		ResourceConfig{Name: "nvidia.com/mig-*"},
+		ResourceConfig{Name: "*.amd.com/gpu"},
+		ResourceConfig{Name: "nvidia.com/gpu"},
+	)
+
+	tests := []struct {
+		description  string
+		resourceName string
+		expectedRule string
+	}{
+		{"exact name wins over every pattern", "nvidia.com/gpu", "nvidia.com/gpu"},
+		{"longer glob wins over shorter glob", "nvidia.com/mig-1g.5gb", "nvidia.com/mig-*"},
+		{"glob matches the resource family", "nvidia.com/gpu.shared", "nvidia.com/*"},
+		{"glob with leading wildcard", "gpu.amd.com/gpu", "*.amd.com/gpu"},
+		{"glob wildcard does not match slash", "a/b.amd.com/gpu", ""},
+		{"regex matches what no glob does", "intel.com/xe-gpu", `regex:[a-z.]+\.com/[a-z-]*gpu`},
+		{"regex matches whole names only", "intel.com/xe-gpu/extra", ""},
+		{"no rule matches", "example.com/fpga", ""},
+	}
+
+	for _, test := range tests {
+		resource, ok := ruleSet.Match(test.resourceName)
+
+		if ok != (test.expectedRule != "") || resource.Rule() != test.expectedRule {
+			t.Errorf("Test (%s) Failed: expected rule %q for %s, got %q", test.description, test.expectedRule, test.resourceName, resource.Rule())
+		}
+	}
+}
+
+func TestResourcePatterns(t *testing.T) {
+	SetActiveRuleSet(newRuleSetFromConfig(t,
+		ResourceConfig{Name: "nvidia.com/*"},
+		ResourceConfig{NameRegex: `(gpu|fpga)\.example\.com/.+`, Tolerations: []TolerationTemplate{{Key: "accelerator", Effect: "NoSchedule"}}},
+	))
+
+	migPod := newPodRequesting("nvidia.com/mig-1g.5gb")
+	expected := newExistsTolerations("nvidia.com/mig-1g.5gb", DefaultTolerationEffects...)
+	if tolerations := GetExtendResourceTolerationsToAdd(&migPod); !newTolerationSet(tolerations).Equal(newTolerationSet(expected)) {
+		t.Errorf("expected tolerations keyed by the matched resource %v, got %v", expected, tolerations)
+	}
+
+	response := mutate(newPodAdmissionReview(t, migPod))
+	if matchedRules := response.AuditAnnotations[matchedRulesAnnotationKey]; matchedRules != "nvidia.com/mig-1g.5gb=nvidia.com/*" {
+		t.Errorf("expected the matched rule in the response, got %q", matchedRules)
+	}
+
+	cases := []struct {
+		description string
+		pod         corev1.Pod
+		allowed     bool
+	}{
+		{"A pod with a MIG slice which tolerates the MIG slice", newPodRequesting("nvidia.com/mig-1g.5gb", newExistsTolerations("nvidia.com/mig-1g.5gb", "")...), true},
+		{"A pod with a MIG slice which tolerates the full GPU", newPodRequesting("nvidia.com/mig-1g.5gb", newExistsTolerations("nvidia.com/gpu", "")...), false},
+		{"A pod with no extended resources which tolerates a resource of the family", newPodRequesting("", newExistsTolerations("nvidia.com/mig-3g.20gb", "")...), false},
+		{"A pod with a regex matched resource which tolerates its taint", newPodRequesting("fpga.example.com/u250", newExistsTolerations("accelerator", "")...), true},
+		{"A pod with no extended resources which tolerates the regex rule taint", newPodRequesting("", newExistsTolerations("accelerator", "")...), false},
+	}
+
+	for _, c := range cases {
+		forbidden := GetForbiddenTolerations(&c.pod)
+
+		if (len(forbidden) == 0) != c.allowed {
+			t.Errorf("Test (%s) Failed: got forbidden tolerations %v, want allowed %v", c.description, forbidden, c.allowed)
+		}
+	}
+}
+
+func TestResourceGroups(t *testing.T) {
+	config := NewConfig()
+	config.Resources = []ResourceConfig{{Name: "nvidia.com/gpu", Effects: []string{"NoSchedule"}}}
+	config.Groups = []ResourceGroup{
+		{
+			Name:            "nvidia-mig",
+			Resources:       []string{"nvidia.com/mig-1g.5gb", "nvidia.com/mig-3g.*"},
+			ResourceRegexes: []string{`nvidia\.com/mig-7g\.[0-9]+gb`},
+			Tolerations:     []TolerationTemplate{{Key: "nvidia.com/gpu", Effect: "NoSchedule"}},
+		},
+	}
+
+	resources, err := config.Validate()
+	if err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	SetTargetResources(resources)
+
+	groupToleration := corev1.Toleration{Key: "nvidia.com/gpu", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule}
+
+	migPod := newPodRequesting("nvidia.com/mig-1g.5gb")
+	migPod.Spec.InitContainers = newPodRequesting("nvidia.com/mig-3g.20gb").Spec.Containers
+	migPod.Spec.Containers = append(migPod.Spec.Containers, newPodRequesting("nvidia.com/mig-7g.80gb").Spec.Containers...)
+
+	tolerations := GetExtendResourceTolerationsToAdd(&migPod)
+	if len(tolerations) != 1 || !isSameToleration(tolerations[0], groupToleration) {
+		t.Errorf("expected the group toleration once, got %v", tolerations)
+	}
+
+	if matchedRules := getMatchedRulesAnnotation(&migPod); matchedRules != "nvidia.com/mig-1g.5gb=group:nvidia-mig,nvidia.com/mig-3g.20gb=group:nvidia-mig,nvidia.com/mig-7g.80gb=group:nvidia-mig" {
+		t.Errorf("expected every member to match the group, got %q", matchedRules)
+	}
+
+	cases := []struct {
+		description string
+		pod         corev1.Pod
+		allowed     bool
+	}{
+		{"A pod with a group member which tolerates the group taint", newPodRequesting("nvidia.com/mig-3g.40gb", groupToleration), true},
+		{"A pod with the full GPU which tolerates the shared taint", newPodRequesting("nvidia.com/gpu", groupToleration), true},
+		{"A pod with a resource outside the group which tolerates the group taint", newPodRequesting("nvidia.com/mig-2g.10gb", groupToleration), false},
+		{"A pod with no extended resources which tolerates the group taint", newPodRequesting("", groupToleration), false},
+	}
+
+	for _, c := range cases {
+		forbidden := GetForbiddenTolerations(&c.pod)
+
+		if (len(forbidden) == 0) != c.allowed {
+			t.Errorf("Test (%s) Failed: got forbidden tolerations %v, want allowed %v", c.description, forbidden, c.allowed)
+		}
+	}
+}
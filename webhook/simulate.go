@@ -0,0 +1,150 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// SimulationResult is the response of the webhooks to an object, as if it
+// was created.
+type SimulationResult struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Ignored is set for objects of kinds the webhooks do not check.
+	Ignored bool `json:"ignored,omitempty"`
+	// Patch is the JSON patch returned by the mutating webhook, if any.
+	Patch json.RawMessage `json:"patch,omitempty"`
+	// Object is the object with the patch applied.
+	Object json.RawMessage `json:"object"`
+	// Allowed is the decision of the webhooks, explained by Message when the
+	// object is denied.
+	Allowed          bool              `json:"allowed"`
+	Message          string            `json:"message,omitempty"`
+	Warnings         []string          `json:"warnings,omitempty"`
+	AuditAnnotations map[string]string `json:"auditAnnotations,omitempty"`
+}
+
+// ReadDocuments splits a multi-document YAML or JSON stream into the JSON of
+// each object, expanding the items of lists. Empty documents are skipped.
+func ReadDocuments(r io.Reader) ([]json.RawMessage, error) {
+	var documents []json.RawMessage
+	decoder := utilyaml.NewYAMLOrJSONDecoder(r, 4096)
+
+	for {
+		var document json.RawMessage
+		if err := decoder.Decode(&document); err == io.EOF {
+			return documents, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("could not parse document %d: %v", len(documents)+1, err)
+		}
+		if len(document) == 0 || bytes.Equal(document, []byte("null")) {
+			continue
+		}
+
+		var list struct {
+			metav1.TypeMeta `json:",inline"`
+			Items           []json.RawMessage `json:"items"`
+		}
+		if err := json.Unmarshal(document, &list); err != nil {
+			return nil, fmt.Errorf("could not parse document %d: %v", len(documents)+1, err)
+		}
+
+		if strings.HasSuffix(list.Kind, "List") {
+			documents = append(documents, list.Items...)
+		} else {
+			documents = append(documents, document)
+		}
+	}
+}
+
+// Simulate runs the mutating and then the validating webhook on the creation
+// of the object by the user, the way the API server chains them. The object
+// is created in the given namespace unless it sets its own.
+func Simulate(object []byte, namespace string, userInfo authenticationv1.UserInfo) (*SimulationResult, error) {
+	req, _, err := newObjectRequest(object, namespace)
+	if err != nil {
+		return nil, err
+	}
+	req.UserInfo = userInfo
+
+	result := &SimulationResult{Kind: req.Kind.Kind, Namespace: req.Namespace, Name: req.Name, Object: object}
+	if _, ok := getWorkloadKind(req); !ok {
+		result.Ignored = true
+		result.Allowed = true
+		return result, nil
+	}
+
+	response := mutate(&admissionv1.AdmissionReview{Request: req})
+	result.AuditAnnotations = response.AuditAnnotations
+	if !response.Allowed {
+		result.Message = response.Result.Message
+		return result, nil
+	}
+
+	if response.Patch != nil {
+		patch, err := jsonpatch.DecodePatch(response.Patch)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode patch: %v", err)
+		}
+		patched, err := patch.Apply(object)
+		if err != nil {
+			return nil, fmt.Errorf("could not apply patch: %v", err)
+		}
+
+		result.Patch = response.Patch
+		result.Object = patched
+		req.Object.Raw = patched
+	}
+
+	validation, err := validateExtendResources(req)
+	result.Warnings = validation.warnings
+	for key, value := range validation.auditAnnotations {
+		if result.AuditAnnotations == nil {
+			result.AuditAnnotations = make(map[string]string)
+		}
+		result.AuditAnnotations[key] = value
+	}
+
+	result.Allowed = err == nil
+	if err != nil {
+		result.Message = err.Error()
+	}
+
+	return result, nil
+}
+
+// newObjectRequest returns the admission request creating the object in the
+// given namespace, unless the object sets its own.
+func newObjectRequest(object []byte, namespace string) (*admissionv1.AdmissionRequest, *metav1.ObjectMeta, error) {
+	var meta struct {
+		metav1.TypeMeta   `json:",inline"`
+		metav1.ObjectMeta `json:"metadata"`
+	}
+	if err := json.Unmarshal(object, &meta); err != nil {
+		return nil, nil, fmt.Errorf("could not deserialize object: %v", err)
+	}
+	if meta.Namespace == "" {
+		meta.Namespace = namespace
+	}
+
+	gvk := schema.FromAPIVersionAndKind(meta.APIVersion, meta.Kind)
+	return &admissionv1.AdmissionRequest{
+		Kind:      metav1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind},
+		Name:      meta.Name,
+		Namespace: meta.Namespace,
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: object},
+	}, &meta.ObjectMeta, nil
+}
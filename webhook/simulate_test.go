@@ -0,0 +1,120 @@
+package webhook
+
+import (
+	"strings"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const simulateManifest = `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: trainer
+spec:
+  containers:
+  - name: cuda
+    resources:
+      limits:
+        nvidia.com/gpu: 1
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: sneaky
+  namespace: ml
+spec:
+  containers:
+  - name: shell
+  tolerations:
+  - key: nvidia.com/gpu
+    operator: Exists
+---
+# an empty document
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: serve
+  spec:
+    template:
+      spec:
+        containers:
+        - name: cuda
+          resources:
+            limits:
+              nvidia.com/gpu: 1
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: settings
+`
+
+func TestSimulate(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+	SetTargetResourcesSet(ArrayFlags{nvidia})
+
+	documents, err := ReadDocuments(strings.NewReader(simulateManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(documents) != 4 {
+		t.Fatalf("expected 4 documents, got %d", len(documents))
+	}
+
+	tests := []struct {
+		description   string
+		namespace     string
+		allowed       bool
+		ignored       bool
+		expectedPatch bool
+	}{
+		{"pod using Nvidia GPU, expect patch", "default", true, false, true},
+		{"pod tolerating Nvidia GPU without using it, expect denial", "ml", false, false, false},
+		{"deployment of a list, expect its template not to be patched", "default", true, false, false},
+		{"configmap of a list, expect it to be ignored", "default", true, true, false},
+	}
+
+	for i, test := range tests {
+		result, err := Simulate(documents[i], "default", authenticationv1.UserInfo{Username: "alice"})
+		if err != nil {
+			t.Errorf("Test (%s) Failed: unexpected error %v", test.description, err)
+			continue
+		}
+
+		if result.Allowed != test.allowed || result.Ignored != test.ignored || (result.Patch != nil) != test.expectedPatch || result.Namespace != test.namespace {
+			t.Errorf("Test (%s) Failed: unexpected result %+v", test.description, result)
+		}
+		if !result.Allowed && !strings.Contains(result.Message, "spec.tolerations[0]") {
+			t.Errorf("Test (%s) Failed: expected the denial to name the toleration, got %q", test.description, result.Message)
+		}
+	}
+
+	result, err := Simulate(documents[0], "default", authenticationv1.UserInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pod corev1.Pod
+	if err := yaml.Unmarshal(result.Object, &pod); err != nil {
+		t.Fatal(err)
+	}
+	if len(pod.Spec.Tolerations) != len(DefaultTolerationEffects) {
+		t.Errorf("expected the resulting object to carry the added tolerations, got %v", pod.Spec.Tolerations)
+	}
+
+	SetMutatePodTemplates(true)
+	defer SetMutatePodTemplates(false)
+	if result, err := Simulate(documents[2], "default", authenticationv1.UserInfo{}); err != nil || result.Patch == nil {
+		t.Errorf("expected the deployment template to be patched with -mutatePodTemplates, got %+v (err: %v)", result, err)
+	}
+
+	if _, err := ReadDocuments(strings.NewReader("kind: [")); err == nil {
+		t.Errorf("expected an invalid document to be rejected")
+	}
+}
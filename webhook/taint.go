@@ -0,0 +1,132 @@
+package webhook
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// guardedTaint is a taint of the nodes providing a target resource, which a
+// pod may only tolerate when it uses the resource.
+type guardedTaint struct {
+	corev1.Taint
+	// anyValue is set when the value of the taint is not known, for taints
+	// derived from a toleration with the Exists operator.
+	anyValue bool
+	// resource is the rule guarding the taint.
+	resource TargetResource
+	// resourceNameKey is set when the taint is keyed by the matched resource
+	// name.
+	resourceNameKey bool
+}
+
+// guardedTaints returns the configured taints of the rule or, without any,
+// the taints tolerated by its tolerations, one per effect for a toleration of
+// every effect.
+func (r TargetResource) guardedTaints() []guardedTaint {
+	var taints []guardedTaint
+
+	if r.Taints != nil {
+		for _, taint := range r.Taints {
+			taints = append(taints, guardedTaint{Taint: taint, resource: r, resourceNameKey: r.isResourceNameKey(taint.Key)})
+		}
+
+		return taints
+	}
+
+	for _, toleration := range r.Tolerations {
+		effects := []corev1.TaintEffect{toleration.Effect}
+		if toleration.Effect == "" {
+			effects = []corev1.TaintEffect{corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute}
+		}
+
+		for _, effect := range effects {
+			taints = append(taints, guardedTaint{
+				Taint:           corev1.Taint{Key: toleration.Key, Value: toleration.Value, Effect: effect},
+				anyValue:        toleration.Operator == corev1.TolerationOpExists,
+				resource:        r,
+				resourceNameKey: r.isResourceNameKey(toleration.Key),
+			})
+		}
+	}
+
+	return taints
+}
+
+// taintsFor returns the taints of the rule for the given matched resource.
+func (r TargetResource) taintsFor(resourceName string) []guardedTaint {
+	var taints []guardedTaint
+
+	for _, taint := range r.guardedTaints() {
+		taints = append(taints, taint.forResource(resourceName))
+	}
+
+	return taints
+}
+
+// forResource returns the taint keyed by the given resource name if it is
+// keyed by the matched resource name.
+func (t guardedTaint) forResource(resourceName string) guardedTaint {
+	if t.resourceNameKey {
+		t.Key = resourceName
+	}
+
+	return t
+}
+
+// resourceDescription names the resource guarding the taint.
+func (t guardedTaint) resourceDescription() string {
+	switch {
+	case t.resource.Group != "":
+		return "of group " + t.resource.Group
+	case t.resourceNameKey && t.Key != "" && t.Key != t.resource.matchExpression():
+		return t.Key
+	case isPatternRule(t.resource):
+		return "matching " + t.resource.matchExpression()
+	default:
+		return t.resource.Name
+	}
+}
+
+// tolerates reports whether the toleration tolerates the taint whatever its
+// value, the way the scheduler matches them.
+func tolerates(toleration corev1.Toleration, taint guardedTaint) bool {
+	if taint.anyValue && toleration.Operator != corev1.TolerationOpExists {
+		return false
+	}
+
+	return toleration.ToleratesTaint(&taint.Taint)
+}
+
+// mayTolerate reports whether the toleration tolerates the taint for some of
+// its values. An operator the scheduler does not know is treated as Exists,
+// erring on the side of denial.
+func mayTolerate(toleration corev1.Toleration, taint guardedTaint) bool {
+	if taint.anyValue || normalizeTolerationOperator(toleration.Operator) != corev1.TolerationOpEqual {
+		toleration.Operator = corev1.TolerationOpExists
+	}
+
+	return toleration.ToleratesTaint(&taint.Taint)
+}
+
+func toleratesTaint(tolerations []corev1.Toleration, taint guardedTaint) bool {
+	for _, toleration := range tolerations {
+		if tolerates(toleration, taint) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getRequiredTolerations returns the tolerations of the target resources
+// used by the pod, and the taints of these resources.
+func getRequiredTolerations(pod *corev1.Pod) ([]corev1.Toleration, []guardedTaint) {
+	var tolerations []corev1.Toleration
+	var taints []guardedTaint
+
+	for resourceName, resource := range GetMatchedRules(pod) {
+		tolerations = append(tolerations, resource.TolerationsFor(resourceName)...)
+		taints = append(taints, resource.taintsFor(resourceName)...)
+	}
+
+	return tolerations, taints
+}
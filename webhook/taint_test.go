@@ -0,0 +1,87 @@
+package webhook
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestTolerationMatching(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+	SetTargetResourcesSet(ArrayFlags{nvidia})
+
+	otherValue := corev1.Toleration{Key: nvidia, Operator: corev1.TolerationOpEqual, Value: "foo"}
+	tolerateEveryEffect := corev1.Toleration{Key: nvidia, Operator: corev1.TolerationOpExists}
+
+	mutateCases := []struct {
+		description string
+		pod         corev1.Pod
+		expected    []corev1.Toleration
+	}{
+		{"A pod with Nvidia GPU which tolerates another value of the taint", newPodRequesting(nvidia, otherValue), newExistsTolerations(nvidia, DefaultTolerationEffects...)},
+		{"A pod with Nvidia GPU which tolerates every effect of the taint", newPodRequesting(nvidia, tolerateEveryEffect), nil},
+	}
+
+	for _, c := range mutateCases {
+		tolerations := GetExtendResourceTolerationsToAdd(&c.pod)
+
+		if !newTolerationSet(tolerations).Equal(newTolerationSet(c.expected)) {
+			t.Errorf("Test (%s) Failed: expected tolerations %v to be added, got %v", c.description, c.expected, tolerations)
+		}
+	}
+
+	nonGpuPod := newPodRequesting("", otherValue)
+	if forbidden := GetForbiddenTolerations(&nonGpuPod); len(forbidden) == 0 {
+		t.Errorf("expected a toleration of a taint with any value to be forbidden")
+	}
+}
+
+func TestConfiguredTaints(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+
+	config := NewConfig()
+	config.Resources = []ResourceConfig{
+		{
+			Name:        nvidia,
+			Tolerations: []TolerationTemplate{{Key: nvidia, Value: "present", Effect: "NoSchedule"}},
+			Taints:      []TaintTemplate{{Value: "present", Effect: "NoSchedule"}},
+		},
+		{
+			Name:   "nvidia.com/mig-*",
+			Taints: []TaintTemplate{{Effect: "NoSchedule"}},
+		},
+	}
+	resources, err := config.Validate()
+	if err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	SetTargetResources(resources)
+
+	presentToleration := corev1.Toleration{Key: nvidia, Operator: corev1.TolerationOpEqual, Value: "present", Effect: corev1.TaintEffectNoSchedule}
+
+	cases := []struct {
+		description string
+		pod         corev1.Pod
+		allowed     bool
+	}{
+		{"A pod with no extended resources which tolerates the taint value", newPodRequesting("", presentToleration), false},
+		{"A pod with no extended resources which tolerates another taint value", newPodRequesting("", corev1.Toleration{Key: nvidia, Operator: corev1.TolerationOpEqual, Value: "absent"}), true},
+		{"A pod with no extended resources which tolerates an effect not tainted", newPodRequesting("", corev1.Toleration{Key: nvidia, Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoExecute}), true},
+		{"A pod with no extended resources which tolerates a MIG slice", newPodRequesting("", corev1.Toleration{Key: "nvidia.com/mig-1g.5gb", Operator: corev1.TolerationOpExists}), false},
+		{"A pod with no extended resources which tolerates an effect a MIG slice is not tainted with", newPodRequesting("", corev1.Toleration{Key: "nvidia.com/mig-1g.5gb", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectPreferNoSchedule}), true},
+		{"A pod with no extended resources which tolerates every NoSchedule taint", newPodRequesting("", corev1.Toleration{Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule}), false},
+	}
+
+	for _, c := range cases {
+		forbidden := append(GetForbiddenTolerations(&c.pod), GetWildcardTolerations(&c.pod)...)
+
+		if (len(forbidden) == 0) != c.allowed {
+			t.Errorf("Test (%s) Failed: got forbidden tolerations %v, want allowed %v", c.description, forbidden, c.allowed)
+		}
+	}
+
+	gpuPod := newPodRequesting(nvidia, corev1.Toleration{Key: nvidia, Operator: corev1.TolerationOpEqual, Value: "absent", Effect: corev1.TaintEffectNoSchedule})
+	if tolerations := GetExtendResourceTolerationsToAdd(&gpuPod); len(tolerations) != 1 || !isSameToleration(tolerations[0], presentToleration) {
+		t.Errorf("expected the toleration of the configured taint to be added, got %v", tolerations)
+	}
+}
@@ -1,17 +1,18 @@
 package webhook
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/klog"
 )
 
@@ -24,6 +25,72 @@ var (
 	podResource           = metav1.GroupVersionResource{Version: "v1", Resource: "pods"}
 )
 
+const (
+	ephemeralContainersSubResource = "ephemeralcontainers"
+	ephemeralContainersKind        = "EphemeralContainers"
+)
+
+// violationsAnnotationKey is the audit annotation listing the tolerations of
+// the taints of extended resources the object does not request.
+const violationsAnnotationKey = "toleration-violations"
+
+var defaultEnforcementMode = EnforcementEnforce
+
+// SetEnforcementMode sets the enforcement mode of the rules which configure
+// none, neither for themselves nor for the whole configuration.
+func SetEnforcementMode(mode string) error {
+	if errs := validateEnforcementMode(mode, field.NewPath("enforcement")); len(errs) != 0 {
+		return errs.ToAggregate()
+	}
+
+	if mode != "" {
+		defaultEnforcementMode = EnforcementMode(mode)
+	}
+	return nil
+}
+
+// enforcementMode returns the enforcement mode of the rule.
+func (r TargetResource) enforcementMode() EnforcementMode {
+	if r.Enforcement != "" {
+		return r.Enforcement
+	}
+
+	return defaultEnforcementMode
+}
+
+// validationResult is reported by the validation of an allowed as well as of
+// a denied object.
+type validationResult struct {
+	warnings         []string
+	auditAnnotations map[string]string
+}
+
+// WildcardTolerationPolicy is the response to a toleration without a key which
+// tolerates the taint of a target resource the pod does not use.
+type WildcardTolerationPolicy string
+
+const (
+	// WildcardTolerationDeny handles wildcard tolerations like any other
+	// toleration, according to the enforcement mode of the rule.
+	WildcardTolerationDeny WildcardTolerationPolicy = "Deny"
+	// WildcardTolerationWarn allows the pod with a warning to the client
+	// where the rule would deny it.
+	WildcardTolerationWarn WildcardTolerationPolicy = "Warn"
+)
+
+var wildcardTolerationPolicy = WildcardTolerationDeny
+
+// SetWildcardTolerationPolicy sets the response to wildcard tolerations.
+func SetWildcardTolerationPolicy(policy string) error {
+	switch WildcardTolerationPolicy(policy) {
+	case WildcardTolerationDeny, WildcardTolerationWarn:
+		wildcardTolerationPolicy = WildcardTolerationPolicy(policy)
+		return nil
+	default:
+		return fmt.Errorf("unsupported wildcard toleration policy %q, expect %s or %s", policy, WildcardTolerationDeny, WildcardTolerationWarn)
+	}
+}
+
 // HandleValidate is a wrapper around validate that adds error handling and logging
 func HandleValidate(w http.ResponseWriter, r *http.Request) {
 	klog.Info("Handling validation request ...")
@@ -64,9 +131,9 @@ func Validate(w http.ResponseWriter, r *http.Request) ([]byte, error) {
 		return nil, fmt.Errorf("unsupported content type %s, only %s is supported", contentType, jsonContentType)
 	}
 
-	// Parse the AdmissionReview request
-	var admissionReviewReq admissionv1.AdmissionReview
-	if _, _, err := universalDeserializer.Decode(body, nil, &admissionReviewReq); err != nil {
+	// Parse the AdmissionReview request, which may be sent as v1 or v1beta1
+	admissionReviewReq, gvk, err := decodeAdmissionReview(body)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return nil, fmt.Errorf("could not deserialize request: %v", err)
 	} else if admissionReviewReq.Request == nil {
@@ -82,19 +149,27 @@ func Validate(w http.ResponseWriter, r *http.Request) ([]byte, error) {
 	}
 
 	// validate the gpu option
-	if err = validateExtendResources(admissionReviewReq.Request); err != nil {
+	result, err := validateExtendResources(admissionReviewReq.Request)
+	admissionReviewResponse.Response.Warnings = result.warnings
+	admissionReviewResponse.Response.AuditAnnotations = result.auditAnnotations
+	if err != nil {
 		// If the handler returned an error, incorporate the error message
 		// into the response and deny the object creation.
 		admissionReviewResponse.Response.Allowed = false
 		admissionReviewResponse.Response.Result = &metav1.Status{
 			Message: err.Error(),
 		}
+
+		var tolerationsErr *tolerationsError
+		if errors.As(err, &tolerationsErr) {
+			admissionReviewResponse.Response.Result = tolerationsErr.status(admissionReviewReq.Request)
+		}
 	} else {
 		admissionReviewResponse.Response.Allowed = true
 	}
 
-	// Return the AdmissionReview with a response as JSON
-	bytes, err := json.Marshal(admissionReviewResponse)
+	// Return the AdmissionReview with a response as JSON, in the version of the request
+	bytes, err := encodeAdmissionReview(gvk, admissionReviewResponse.Response)
 	if err != nil {
 		return nil, fmt.Errorf("marshaling response: %v", err)
 	}
@@ -102,29 +177,132 @@ func Validate(w http.ResponseWriter, r *http.Request) ([]byte, error) {
 }
 
 // validateExtendResources validates wether the given request has permission on
-// using extended resources.
-func validateExtendResources(req *admissionv1.AdmissionRequest) error {
-	// This handler should only get called on Pod objects.
-	// However, if different kind of object is invoked, issue a log message
-	// but let the object request pass through.
-
-	if req.Resource != podResource {
-		klog.Infof("expect resource to be: %s, instead request resource: %s", podResource, req.Resource)
-		return nil
+// using extended resources. Pods are validated as well as the pod templates of
+// workloads, so that a workload is denied when it is applied rather than when
+// its pods are created. An update is not validated for the tolerations which
+// already violated the rules in the object it replaces. Each violation is handled according to the enforcement
+// mode of the rule it violates: denied, allowed with a warning, or allowed and
+// only recorded in the audit annotations.
+func validateExtendResources(req *admissionv1.AdmissionRequest) (validationResult, error) {
+	var result validationResult
+
+	// Tolerations can only change through the object itself. Up to
+	// Kubernetes 1.22 the pods/ephemeralcontainers subresource sends an
+	// EphemeralContainers object, which carries no tolerations; later
+	// versions send the whole pod, which is validated like any other.
+	if req.SubResource != "" && req.SubResource != ephemeralContainersSubResource {
+		klog.Infof("expect no subresource or %s, instead request subresource: %s", ephemeralContainersSubResource, req.SubResource)
+		return result, nil
+	}
+	if req.SubResource == ephemeralContainersSubResource && req.Kind.Kind == ephemeralContainersKind {
+		return result, nil
 	}
 
-	// Parse the Pod object.
-	raw := req.Object.Raw
-	pod := corev1.Pod{}
-	if _, _, err := universalDeserializer.Decode(raw, nil, &pod); err != nil {
-		return fmt.Errorf("could not deserialize pod object: %v", err)
+	if reason := GetActiveRuleSet().exemptionReason(req.Namespace); reason != "" {
+		klog.Infof("Allowing %s/%s: %s", req.Namespace, req.Name, reason)
+		result.auditAnnotations = map[string]string{exemptionAnnotationKey: reason}
+		return result, nil
 	}
 
-	extendedResourcesUsedByPod := GetExtendResourcesUsedByPod(&pod)
-	extenedResourceTolerationsUsedByPod := GetExtendResourceTolerationsUsedByPod(&pod)
+	// This handler should only get called on pods and workloads. However, if
+	// different kind of object is invoked, issue a log message but let the
+	// object request pass through.
+	template, err := getPodTemplate(req)
+	if err != nil {
+		return result, err
+	}
+	if template == nil {
+		klog.Infof("expect resource to be a pod or workload, instead request resource: %s", req.Resource)
+		return result, nil
+	}
 
-	if !(*extenedResourceTolerationsUsedByPod).IsSubset(*extendedResourcesUsedByPod) {
-		return fmt.Errorf("Forbidden Toleration Usage")
+	// On update the tolerations which already violated the rules in the
+	// replaced object are not validated, so that objects admitted before can
+	// still be updated. A toleration the replaced object was allowed, e.g.
+	// because of a resource request the update removes, is validated.
+	oldTemplate, err := getOldPodTemplate(req)
+	if err != nil {
+		return result, err
+	}
+	var oldViolations []corev1.Toleration
+	if oldTemplate != nil {
+		violations, _ := getTolerationViolations(&oldTemplate.Pod, newRequester(req, oldTemplate))
+		for _, violation := range violations {
+			oldViolations = append(oldViolations, violation.toleration)
+		}
+	}
+
+	var violations, denied field.ErrorList
+	tolerationsPath := template.tolerationsPath()
+	tolerationViolations, exemptions := getTolerationViolations(&template.Pod, newRequester(req, template))
+	for _, violation := range tolerationViolations {
+		if hasToleration(oldViolations, violation.toleration) {
+			continue
+		}
+
+		err := field.Forbidden(tolerationsPath.Index(violation.index), violation.message())
+		violations = append(violations, err)
+
+		mode := violation.taint.resource.enforcementMode()
+		if mode == EnforcementEnforce && violation.isWildcard() && wildcardTolerationPolicy == WildcardTolerationWarn {
+			mode = EnforcementWarn
+		}
+
+		switch mode {
+		case EnforcementEnforce:
+			denied = append(denied, err)
+		case EnforcementWarn:
+			result.warnings = append(result.warnings, err.Error())
+		}
+	}
+
+	if len(violations) != 0 || len(exemptions) != 0 {
+		result.auditAnnotations = map[string]string{}
+	}
+	if len(violations) != 0 {
+		result.auditAnnotations[violationsAnnotationKey] = violations.ToAggregate().Error()
+	}
+	if len(exemptions) != 0 {
+		result.auditAnnotations[exemptionAnnotationKey] = strings.Join(exemptions, "; ")
+	}
+	if len(denied) != 0 {
+		return result, &tolerationsError{errs: denied}
+	}
+
+	return result, nil
+}
+
+// tolerationsError denies an object whose tolerations tolerate the taints of
+// extended resources it does not request, with a cause per toleration.
+type tolerationsError struct {
+	errs field.ErrorList
+}
+
+func (e *tolerationsError) Error() string {
+	return fmt.Sprintf("Forbidden Toleration Usage: %v", e.errs.ToAggregate())
+}
+
+// status returns the error as a Forbidden status of the requested object,
+// with the field path of each offending toleration as a cause.
+func (e *tolerationsError) status(req *admissionv1.AdmissionRequest) *metav1.Status {
+	details := &metav1.StatusDetails{
+		Name:  req.Name,
+		Group: req.Resource.Group,
+		Kind:  req.Resource.Resource,
+	}
+	for _, err := range e.errs {
+		details.Causes = append(details.Causes, metav1.StatusCause{
+			Type:    metav1.CauseType(err.Type),
+			Message: err.ErrorBody(),
+			Field:   err.Field,
+		})
+	}
+
+	return &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Message: e.Error(),
+		Reason:  metav1.StatusReasonForbidden,
+		Code:    http.StatusForbidden,
+		Details: details,
 	}
-	return nil
 }
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
 
 	admissionv1 "k8s.io/api/admission/v1"
@@ -13,6 +15,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 )
 
 const (
@@ -109,6 +112,29 @@ func TestValidate(t *testing.T) {
 			},
 		},
 	}
+	gpuLimitsOnlyPodWithGpuTolerations := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Resources: corev1.ResourceRequirements{
+						Limits: corev1.ResourceList{
+							corev1.ResourceName(nvidia): *resource.NewQuantity(1, resource.DecimalSI),
+						},
+					},
+				},
+			},
+			Tolerations: []corev1.Toleration{
+				{
+					Key:      nvidia,
+					Operator: "NoSchedule",
+				},
+				{
+					Key:      nvidia,
+					Operator: "NoExecute",
+				},
+			},
+		},
+	}
 	nonGpuPodWithGpuTolerations1 := corev1.Pod{
 		Spec: corev1.PodSpec{
 			Containers: []corev1.Container{
@@ -185,6 +211,14 @@ func TestValidate(t *testing.T) {
 			},
 			want: admissionv1.AdmissionReview{Response: &admissionv1.AdmissionResponse{UID: uid, Allowed: false}},
 		},
+		{
+			description: "A pod with Nvidia GPU only in limits which has tolerations",
+			in: admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{Kind: "pods", APIVersion: "v1"},
+				Request:  &admissionv1.AdmissionRequest{UID: uid, Resource: podResource, Object: runtime.RawExtension{Raw: marshal(gpuLimitsOnlyPodWithGpuTolerations)}},
+			},
+			want: admissionv1.AdmissionReview{Response: &admissionv1.AdmissionResponse{UID: uid, Allowed: true}},
+		},
 		{
 			description: "A pod with no extended resources which has Nvidia tolerations",
 			in: admissionv1.AdmissionReview{
@@ -231,3 +265,416 @@ func TestValidate(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateMappedTaintKeys(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+	amd := "amd.com/gpu"
+
+	config := NewConfig()
+	config.Resources = []ResourceConfig{
+		{Name: nvidia, Tolerations: []TolerationTemplate{
+			{Key: "gpu-node", Value: "true", Effect: "NoSchedule"},
+			{Key: "accelerator", Effect: "NoSchedule"},
+		}},
+		{Name: amd, Tolerations: []TolerationTemplate{
+			{Key: "accelerator", Effect: "NoSchedule"},
+		}},
+	}
+	resources, err := config.Validate()
+	if err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	SetTargetResources(resources)
+
+	gpuNodeToleration := corev1.Toleration{Key: "gpu-node", Operator: corev1.TolerationOpEqual, Value: "true", Effect: corev1.TaintEffectNoSchedule}
+	acceleratorToleration := corev1.Toleration{Key: "accelerator", Operator: corev1.TolerationOpExists}
+	resourceNameToleration := corev1.Toleration{Key: nvidia, Operator: corev1.TolerationOpExists}
+
+	cases := []struct {
+		description string
+		pod         corev1.Pod
+		allowed     bool
+	}{
+		{"A pod with Nvidia GPU which tolerates the mapped taint", newPodRequesting(nvidia, gpuNodeToleration), true},
+		{"A pod with AMD GPU which tolerates the shared taint", newPodRequesting(amd, acceleratorToleration), true},
+		{"A pod with AMD GPU which tolerates the Nvidia only taint", newPodRequesting(amd, gpuNodeToleration), false},
+		{"A pod with no extended resources which tolerates the shared taint", newPodRequesting("", acceleratorToleration), false},
+		{"A pod with no extended resources which tolerates the resource name", newPodRequesting("", resourceNameToleration), true},
+	}
+
+	for _, c := range cases {
+		t.Logf("\tTest: %v", c.description)
+		_, err := validateExtendResources(&admissionv1.AdmissionRequest{Resource: podResource, Object: runtime.RawExtension{Raw: marshal(c.pod)}})
+
+		if (err == nil) != c.allowed {
+			t.Errorf("\t%s\tunexpected result: got %v want allowed %v", failed, err, c.allowed)
+		} else {
+			t.Logf("\t%s\treturned: %v.", succeed, err)
+		}
+	}
+
+	mappedPod := newPodRequesting(nvidia, gpuNodeToleration)
+	tolerationsToAdd := GetExtendResourceTolerationsToAdd(&mappedPod)
+	expected := []corev1.Toleration{{Key: "accelerator", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule}}
+	if !reflect.DeepEqual(tolerationsToAdd, expected) {
+		t.Errorf("\t%s\texpected the mapped tolerations %v to be added, got %v", failed, expected, tolerationsToAdd)
+	}
+}
+
+func TestValidateEphemeralContainersAndOverhead(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+	SetTargetResourcesSet(ArrayFlags{nvidia})
+
+	gpuToleration := corev1.Toleration{Key: nvidia, Operator: corev1.TolerationOpExists}
+
+	ephemeralPod := newPodRequesting("", gpuToleration)
+	ephemeralPod.Spec.EphemeralContainers = []corev1.EphemeralContainer{{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+			Name:      "debugger",
+			Resources: newPodRequesting(nvidia).Spec.Containers[0].Resources,
+		},
+	}}
+	overheadPod := newPodRequesting("", gpuToleration)
+	overheadPod.Spec.Overhead = corev1.ResourceList{
+		corev1.ResourceName(nvidia): *resource.NewQuantity(1, resource.DecimalSI),
+	}
+	ephemeralContainers, err := json.Marshal(corev1.EphemeralContainers{
+		TypeMeta:            metav1.TypeMeta{Kind: ephemeralContainersKind, APIVersion: "v1"},
+		EphemeralContainers: ephemeralPod.Spec.EphemeralContainers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		description string
+		request     admissionv1.AdmissionRequest
+		allowed     bool
+	}{
+		{
+			description: "A pod with Nvidia GPU only in an ephemeral container which has tolerations",
+			request:     admissionv1.AdmissionRequest{Resource: podResource, Object: runtime.RawExtension{Raw: marshal(ephemeralPod)}},
+			allowed:     true,
+		},
+		{
+			description: "A pod with Nvidia GPU only in its overhead which has tolerations",
+			request:     admissionv1.AdmissionRequest{Resource: podResource, Object: runtime.RawExtension{Raw: marshal(overheadPod)}},
+			allowed:     true,
+		},
+		{
+			description: "A pod sent to the ephemeralcontainers subresource with forbidden tolerations",
+			request:     admissionv1.AdmissionRequest{Resource: podResource, SubResource: ephemeralContainersSubResource, Kind: metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}, Object: runtime.RawExtension{Raw: marshal(newPodRequesting("", gpuToleration))}},
+			allowed:     false,
+		},
+		{
+			description: "An EphemeralContainers object sent to the ephemeralcontainers subresource",
+			request:     admissionv1.AdmissionRequest{Resource: podResource, SubResource: ephemeralContainersSubResource, Kind: metav1.GroupVersionKind{Version: "v1", Kind: ephemeralContainersKind}, Object: runtime.RawExtension{Raw: ephemeralContainers}},
+			allowed:     true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("\tTest: %v", c.description)
+		_, err := validateExtendResources(&c.request)
+
+		if (err == nil) != c.allowed {
+			t.Errorf("\t%s\tunexpected result: got %v want allowed %v", failed, err, c.allowed)
+		} else {
+			t.Logf("\t%s\treturned: %v.", succeed, err)
+		}
+	}
+
+	expected := newExistsTolerations(nvidia, DefaultTolerationEffects...)
+	for _, pod := range []corev1.Pod{ephemeralPod, overheadPod} {
+		pod.Spec.Tolerations = nil
+		if tolerations := GetExtendResourceTolerationsToAdd(&pod); !newTolerationSet(tolerations).Equal(newTolerationSet(expected)) {
+			t.Errorf("\t%s\texpected tolerations %v to be added, got %v", failed, expected, tolerations)
+		}
+	}
+
+	ar := newPodAdmissionReview(t, ephemeralPod)
+	ar.Request.SubResource = ephemeralContainersSubResource
+	if response := mutate(ar); !response.Allowed || response.Patch != nil {
+		t.Errorf("\t%s\texpected no patch for the ephemeralcontainers subresource, got %s", failed, response.Patch)
+	}
+}
+
+func TestValidateWildcardTolerations(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+	amd := "amd.com/gpu"
+	SetTargetResourcesSet(ArrayFlags{nvidia, amd + ":NoSchedule"})
+
+	tolerateAll := corev1.Toleration{Operator: corev1.TolerationOpExists}
+	tolerateNoSchedule := corev1.Toleration{Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule}
+	tolerateNoExecute := corev1.Toleration{Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoExecute}
+	toleratePreferNoSchedule := corev1.Toleration{Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectPreferNoSchedule}
+
+	nvidiaAndAMDPod := newPodRequesting(nvidia, tolerateAll)
+	nvidiaAndAMDPod.Spec.Containers = append(nvidiaAndAMDPod.Spec.Containers, newPodRequesting(amd).Spec.Containers...)
+
+	cases := []struct {
+		description string
+		pod         corev1.Pod
+		allowed     bool
+	}{
+		{"A pod with no extended resources which tolerates every taint", newPodRequesting("", tolerateAll), false},
+		{"A pod with no extended resources which tolerates every NoSchedule taint", newPodRequesting("", tolerateNoSchedule), false},
+		{"A pod with no extended resources which tolerates every PreferNoSchedule taint", newPodRequesting("", toleratePreferNoSchedule), true},
+		{"A pod with Nvidia GPU which tolerates every taint", newPodRequesting(nvidia, tolerateAll), false},
+		{"A pod with Nvidia GPU which tolerates every NoExecute taint", newPodRequesting(nvidia, tolerateNoExecute), true},
+		{"A pod with Nvidia and AMD GPU which tolerates every taint", nvidiaAndAMDPod, true},
+		{"A pod with no extended resources which tolerates another taint key", newPodRequesting("", corev1.Toleration{Key: "foo", Operator: corev1.TolerationOpExists}), true},
+	}
+
+	for _, c := range cases {
+		t.Logf("\tTest: %v", c.description)
+		_, err := validateExtendResources(&admissionv1.AdmissionRequest{Resource: podResource, Object: runtime.RawExtension{Raw: marshal(c.pod)}})
+
+		if (err == nil) != c.allowed {
+			t.Errorf("\t%s\tunexpected result: got %v want allowed %v", failed, err, c.allowed)
+		} else {
+			t.Logf("\t%s\treturned: %v.", succeed, err)
+		}
+	}
+
+	if err := SetWildcardTolerationPolicy("Ignore"); err == nil {
+		t.Errorf("\t%s\texpected an unsupported policy to be rejected", failed)
+	}
+	if err := SetWildcardTolerationPolicy(string(WildcardTolerationWarn)); err != nil {
+		t.Fatal(err)
+	}
+	defer SetWildcardTolerationPolicy(string(WildcardTolerationDeny))
+
+	result, err := validateExtendResources(&admissionv1.AdmissionRequest{Resource: podResource, Object: runtime.RawExtension{Raw: marshal(newPodRequesting("", tolerateAll))}})
+	if err != nil || len(result.warnings) != 1 {
+		t.Errorf("\t%s\texpected the pod to be allowed with a warning, got %v (err: %v)", failed, result.warnings, err)
+	}
+}
+
+func TestValidateDenialDetails(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+	amd := "amd.com/gpu"
+	SetTargetResourcesSet(ArrayFlags{nvidia, amd})
+
+	otherToleration := corev1.Toleration{Key: "foo", Operator: corev1.TolerationOpExists}
+	amdToleration := corev1.Toleration{Key: amd, Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule}
+	wildcardToleration := corev1.Toleration{Operator: corev1.TolerationOpExists}
+	pod := newPodRequesting(nvidia, otherToleration, amdToleration, wildcardToleration)
+
+	tests := []struct {
+		description    string
+		request        *admissionv1.AdmissionRequest
+		expectedFields []string
+	}{
+		{
+			description:    "pod",
+			request:        &admissionv1.AdmissionRequest{UID: "D3N13D", Name: "gpu-pod", Resource: podResource, Object: runtime.RawExtension{Raw: marshal(pod)}},
+			expectedFields: []string{"spec.tolerations[1]", "spec.tolerations[2]"},
+		},
+		{
+			description:    "cronjob",
+			request:        newWorkloadRequest(t, "batch", "v1", "cronjobs", pod),
+			expectedFields: []string{"spec.jobTemplate.spec.template.spec.tolerations[1]", "spec.jobTemplate.spec.template.spec.tolerations[2]"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Logf("\tTest: %v", test.description)
+		body, err := json.Marshal(admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+			Request:  test.request,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(body))
+		req.Header.Set("Content-Type", jsonContentType)
+		rr := httptest.NewRecorder()
+		HandleValidate(rr, req)
+
+		var admissionReview admissionv1.AdmissionReview
+		if err := json.Unmarshal(rr.Body.Bytes(), &admissionReview); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+
+		response := admissionReview.Response
+		if response.Allowed || response.Result == nil || response.Result.Details == nil {
+			t.Errorf("\t%s\texpected a denial with details, got %v", failed, response)
+			continue
+		}
+
+		status := response.Result
+		if status.Code != http.StatusForbidden || status.Reason != metav1.StatusReasonForbidden || status.Details.Name != test.request.Name {
+			t.Errorf("\t%s\texpected a Forbidden status of %s, got %v", failed, test.request.Name, status)
+		}
+
+		var fields []string
+		for _, cause := range status.Details.Causes {
+			fields = append(fields, cause.Field)
+			if cause.Type != metav1.CauseType(field.ErrorTypeForbidden) {
+				t.Errorf("\t%s\texpected a Forbidden cause, got %v", failed, cause)
+			}
+		}
+		if !reflect.DeepEqual(fields, test.expectedFields) {
+			t.Errorf("\t%s\texpected causes for %v, got %v", failed, test.expectedFields, fields)
+		}
+
+		for _, expected := range []string{`key="amd.com/gpu"`, "extended resource amd.com/gpu", "not requested by any container", "tolerates every taint key"} {
+			if !strings.Contains(status.Message, expected) {
+				t.Errorf("\t%s\texpected message to contain %q, got %q", failed, expected, status.Message)
+			}
+		}
+		t.Logf("\t%s\tdenied: %s", succeed, status.Message)
+	}
+}
+
+func TestEnforcementModes(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+	amd := "amd.com/gpu"
+	fpga := "xilinx.com/fpga"
+
+	config := NewConfig()
+	config.Enforcement = string(EnforcementAudit)
+	config.Resources = []ResourceConfig{
+		{Name: nvidia, Enforcement: string(EnforcementEnforce)},
+		{Name: amd, Enforcement: string(EnforcementWarn)},
+		{Name: fpga},
+	}
+	resources, err := config.Validate()
+	if err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	SetTargetResources(resources)
+
+	tolerate := func(key string) corev1.Toleration {
+		return corev1.Toleration{Key: key, Operator: corev1.TolerationOpExists}
+	}
+
+	cases := []struct {
+		description      string
+		pod              corev1.Pod
+		allowed          bool
+		expectedWarnings int
+		audited          bool
+	}{
+		{"A pod with no extended resources which tolerates an enforced taint", newPodRequesting("", tolerate(nvidia)), false, 0, true},
+		{"A pod with no extended resources which tolerates a warned taint", newPodRequesting("", tolerate(amd)), true, 1, true},
+		{"A pod with no extended resources which tolerates a taint audited by the config", newPodRequesting("", tolerate(fpga)), true, 0, true},
+		{"A pod with no extended resources which tolerates warned and audited taints", newPodRequesting("", tolerate(amd), tolerate(fpga)), true, 1, true},
+		{"A pod with no extended resources which tolerates every taint, reported for the strictest rule", newPodRequesting("", corev1.Toleration{Operator: corev1.TolerationOpExists}), false, 0, true},
+		{"A pod with Nvidia GPU which tolerates its taint", newPodRequesting(nvidia, tolerate(nvidia)), true, 0, false},
+	}
+
+	for _, c := range cases {
+		t.Logf("\tTest: %v", c.description)
+		result, err := validateExtendResources(&admissionv1.AdmissionRequest{Resource: podResource, Object: runtime.RawExtension{Raw: marshal(c.pod)}})
+
+		_, audited := result.auditAnnotations[violationsAnnotationKey]
+		if (err == nil) != c.allowed || len(result.warnings) != c.expectedWarnings || audited != c.audited {
+			t.Errorf("\t%s\tunexpected result: got %v with warnings %v and audit annotations %v, want allowed %v with %d warnings, audited %v",
+				failed, err, result.warnings, result.auditAnnotations, c.allowed, c.expectedWarnings, c.audited)
+		} else {
+			t.Logf("\t%s\treturned: %v.", succeed, err)
+		}
+	}
+
+	if err := SetEnforcementMode("Ignore"); err == nil {
+		t.Errorf("\t%s\texpected an unsupported enforcement mode to be rejected", failed)
+	}
+	if err := SetEnforcementMode(string(EnforcementWarn)); err != nil {
+		t.Fatal(err)
+	}
+	defer SetEnforcementMode(string(EnforcementEnforce))
+	SetTargetResourcesSet(ArrayFlags{nvidia})
+
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  &admissionv1.AdmissionRequest{UID: "W4RN", Resource: podResource, Object: runtime.RawExtension{Raw: marshal(newPodRequesting("", tolerate(nvidia)))}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(body))
+	req.Header.Set("Content-Type", jsonContentType)
+	rr := httptest.NewRecorder()
+	HandleValidate(rr, req)
+
+	var admissionReview admissionv1.AdmissionReview
+	if err := json.Unmarshal(rr.Body.Bytes(), &admissionReview); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if response := admissionReview.Response; !response.Allowed || len(response.Warnings) != 1 || response.AuditAnnotations[violationsAnnotationKey] == "" {
+		t.Errorf("\t%s\texpected the flag enforcement mode to allow with a warning, got %v", failed, response)
+	}
+}
+
+// newPodRequesting returns a pod with a container limiting one of the given
+// resource, or no container for an empty resource name.
+func newPodRequesting(resourceName string, tolerations ...corev1.Toleration) corev1.Pod {
+	pod := corev1.Pod{Spec: corev1.PodSpec{Tolerations: tolerations}}
+	if resourceName != "" {
+		pod.Spec.Containers = []corev1.Container{{
+			Resources: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{
+					corev1.ResourceName(resourceName): *resource.NewQuantity(1, resource.DecimalSI),
+				},
+			},
+		}}
+	}
+
+	return pod
+}
+
+func TestValidateUpdate(t *testing.T) {
+	nvidia := "nvidia.com/gpu"
+	SetTargetResourcesSet(ArrayFlags{nvidia})
+
+	gpuToleration := corev1.Toleration{Key: nvidia, Operator: corev1.TolerationOpExists}
+	otherToleration := corev1.Toleration{Key: "foo", Operator: corev1.TolerationOpExists}
+
+	cases := []struct {
+		description string
+		resource    string
+		oldPod      corev1.Pod
+		pod         corev1.Pod
+		allowed     bool
+	}{
+		{"Adding a GPU toleration to a running pod with no extended resources",
+			"pods", newPodRequesting(""), newPodRequesting("", gpuToleration), false},
+		{"Adding a GPU toleration next to an unrelated one",
+			"pods", newPodRequesting("", otherToleration), newPodRequesting("", otherToleration, gpuToleration), false},
+		{"Updating a pod admitted with a GPU toleration before the webhook, which keeps it",
+			"pods", newPodRequesting("", gpuToleration), newPodRequesting("", gpuToleration, otherToleration), true},
+		{"Changing a GPU toleration of a pod admitted before the webhook",
+			"pods", newPodRequesting("", gpuToleration), newPodRequesting("", corev1.Toleration{Key: nvidia, Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoExecute}), false},
+		{"Adding a GPU toleration to the template of a deployment with no extended resources",
+			"deployments", newPodRequesting(""), newPodRequesting("", gpuToleration), false},
+		{"Updating a deployment admitted with a GPU toleration before the webhook, which keeps it",
+			"deployments", newPodRequesting("", gpuToleration), newPodRequesting("", gpuToleration), true},
+		{"Removing the GPU request of a deployment which keeps the GPU toleration",
+			"deployments", newPodRequesting(nvidia, gpuToleration), newPodRequesting("", gpuToleration), false},
+		{"Removing the GPU request of a pod which keeps the GPU toleration",
+			"pods", newPodRequesting(nvidia, gpuToleration), newPodRequesting("", gpuToleration), false},
+		{"Updating a deployment requesting GPU which keeps its GPU toleration",
+			"deployments", newPodRequesting(nvidia, gpuToleration), newPodRequesting(nvidia, gpuToleration, otherToleration), true},
+	}
+
+	for _, c := range cases {
+		t.Logf("\tTest: %v", c.description)
+		group := ""
+		if c.resource == "deployments" {
+			group = "apps"
+		}
+		req := newWorkloadRequest(t, group, "v1", c.resource, c.pod)
+		req.Operation = admissionv1.Update
+		req.OldObject = newWorkloadRequest(t, group, "v1", c.resource, c.oldPod).Object
+
+		_, err := validateExtendResources(req)
+		if (err == nil) != c.allowed {
+			t.Errorf("\t%s\tunexpected result: got %v, want allowed %v", failed, err, c.allowed)
+		} else {
+			t.Logf("\t%s\treturned: %v.", succeed, err)
+		}
+	}
+}